@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes the file through a temporary file in the same
+// directory that is synced and renamed over path, so a crash never leaves a
+// half written file behind. The result gets the permission bits of src (0644
+// if src does not exist) and with keepMtime also its modification time.
+func WriteFileAtomic(path string, src string, keepMtime bool, write func(w io.Writer) error) error {
+	perm := os.FileMode(0o644)
+
+	info, err := os.Stat(src)
+	if err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	// replace the file a symlink points to, not the symlink
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		path = resolved
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	// no-op once the rename went through
+	defer os.Remove(tmp.Name())
+
+	wr := bufio.NewWriter(tmp)
+	err = write(wr)
+	if err == nil {
+		err = wr.Flush()
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	if keepMtime && info != nil {
+		err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
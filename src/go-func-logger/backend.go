@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// -backend, what the injected logs are written with
+const (
+	BackendFmt     = "fmt"     // fmt.Printf to stdout
+	BackendLog     = "log"     // log.Printf, through the standard logger and however the program set it up
+	BackendSlog    = "slog"    // slog.Debug with the fields as attributes, through the default slog logger
+	BackendZap     = "zap"     // zap's Debug with typed fields, through zap.L() or -logger
+	BackendZerolog = "zerolog" // zerolog's chained Debug().Str(...).Msg(...), through the global logger or -logger
+	BackendLogrus  = "logrus"  // logrus.WithFields(...).Debug(...), through the standard logger or -logger
+)
+
+// the message structured backends log an event with, the fields carry the rest
+var EventMessages = map[string]string{
+	EventEnter:       "func entry",
+	EventExit:        "func exit",
+	EventPanic:       "panic",
+	EventStart:       "program start",
+	EventFinish:      "program finish",
+	EventProgramExit: "program exit",
+	EventProcess:     "process",
+}
+
+// structured backends log panics as errors, everything else for debugging
+func IsErrorEvent(event string) bool {
+	return event == EventPanic
+}
+
+// -level, what the logs are logged at and gated on at run time
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// LogLevel is the level a log of the event is logged at, debug unless -level
+// says otherwise. Panics are errors whatever -level is.
+func LogLevel(event string, opts Options) string {
+	if IsErrorEvent(event) {
+		return LevelError
+	}
+
+	if opts.Level == "" {
+		return LevelDebug
+	}
+
+	return opts.Level
+}
+
+// LevelMethod is the name of the method logging at level, the same for every
+// structured backend, and of the runtime's constant for it after Level
+func LevelMethod(level string) string {
+	return strings.ToUpper(level[:1]) + level[1:]
+}
+
+// GateLog makes a log statement depend on its call being logged at all, see
+// CallLogVar, on logging being on, turned on by GOFUNCLOG=1 for -kill-switch
+// and SIGUSR1 for -signals, on its level being enabled by FUNCLOG_LEVEL for
+// -level and on the function having logged less than -rate-limit lines in
+// the last second, the cheapest check first
+func GateLog(msg Message, log string, opts Options) string {
+	var conds []string
+
+	if msg.Gated {
+		conds = append(conds, CallLogVar)
+	}
+
+	if opts.KillSwitch || opts.Signals {
+		conds = append(conds, RuntimeName+".On()")
+	}
+
+	if opts.Level != "" {
+		conds = append(conds, fmt.Sprintf("%s.Enabled(%s.Level%s)", RuntimeName, RuntimeName, LevelMethod(LogLevel(msg.Event, opts))))
+	}
+
+	if opts.RateLimit > 0 && msg.Func != "" {
+		conds = append(conds, fmt.Sprintf("%s.Allow(%s, %d)", RuntimeName, strconv.Quote(msg.Func), opts.RateLimit))
+	}
+
+	if len(conds) == 0 {
+		return log
+	}
+
+	return fmt.Sprintf("if %s { %s }", strings.Join(conds, " && "), log)
+}
+
+func IsStructuredBackend(opts Options) bool {
+	return opts.Backend == BackendSlog || opts.Backend == BackendZap || opts.Backend == BackendZerolog || opts.Backend == BackendLogrus
+}
+
+// LogImport is a package the injected logs call. Backends are imported under
+// a name of their own so they can't clash with what the file imports itself.
+type LogImport struct {
+	Name string
+	Path string
+}
+
+// the package the logs of the backend are written with, if it has to be
+// imported
+func BackendImport(opts Options) (LogImport, bool) {
+	if opts.LogCall != "" && opts.LogImport != "" {
+		return LogImport{Name: "funclogcall", Path: opts.LogImport}, true
+	}
+
+	switch opts.Backend {
+	case BackendLog:
+		return LogImport{Name: "funcloglog", Path: "log"}, true
+	case BackendSlog:
+		return LogImport{Name: "funclogslog", Path: "log/slog"}, true
+	case BackendZap:
+		return LogImport{Name: "funclogzap", Path: "go.uber.org/zap"}, true
+	case BackendZerolog:
+		// the fields are methods of the event, only the global logger needs
+		// an import
+		if opts.Logger == "" {
+			return LogImport{Name: "funclogzerolog", Path: "github.com/rs/zerolog/log"}, true
+		}
+	case BackendLogrus:
+		return LogImport{Name: "funcloglogrus", Path: "github.com/sirupsen/logrus"}, true
+	}
+
+	return LogImport{}, false
+}
+
+// the packages the injected logs may import, besides the runtime
+func LogImportPaths(opts Options) []string {
+	paths := []string{"fmt"}
+	if opts.Recover {
+		paths = append(paths, "runtime/debug")
+	}
+
+	if imp, ok := BackendImport(opts); ok {
+		paths = append(paths, imp.Path)
+	}
+
+	return paths
+}
+
+// the fields of a message for the structured backends, which have a time and
+// a message of their own
+func GetStructuredFields(msg Message, opts Options) []Field {
+	var fields []Field
+
+	for _, field := range GetPrefixFields(msg.Event, opts) {
+		if field.Key != "time" && field.Key != "event" {
+			fields = append(fields, field)
+		}
+	}
+
+	return append(fields, msg.Fields...)
+}
+
+// FieldValue is the Go expression of the value of a field for the structured
+// backends. Fields printed with %T or %p hold the value the verb describes,
+// not the value to log.
+func FieldValue(field Field) string {
+	switch field.Verb {
+	case "":
+		if field.Type == "int" {
+			return field.Value
+		}
+
+		return strconv.Quote(field.Value)
+	case "%T", "%p":
+		return fmt.Sprintf("fmt.Sprintf(%q, %s)", field.Verb, field.Expr)
+	}
+
+	return field.Expr
+}
+
+// the slog call for a message, its fields become key value pairs
+func SlogLog(msg Message, opts Options) string {
+	imp, _ := BackendImport(opts)
+
+	level := LevelMethod(LogLevel(msg.Event, opts))
+
+	args := []string{strconv.Quote(EventMessages[msg.Event])}
+	for _, field := range GetStructuredFields(msg, opts) {
+		args = append(args, strconv.Quote(field.Key), FieldValue(field))
+	}
+
+	return fmt.Sprintf("%s.%s(%s)", imp.Name, level, strings.Join(args, ", "))
+}
+
+// FieldType is the Go type of the value FieldValue returns, empty if unknown
+func FieldType(field Field) string {
+	switch field.Verb {
+	case "":
+		if field.Type == "" {
+			return "string"
+		}
+	case "%T", "%p", "%q", "%s":
+		return "string"
+	}
+
+	return field.Type
+}
+
+// the zap field constructors for the types they take without conversion
+var zapFields = map[string]string{
+	"string":        "String",
+	"bool":          "Bool",
+	"int":           "Int",
+	"int8":          "Int8",
+	"int16":         "Int16",
+	"int32":         "Int32",
+	"int64":         "Int64",
+	"uint":          "Uint",
+	"uint8":         "Uint8",
+	"uint16":        "Uint16",
+	"uint32":        "Uint32",
+	"uint64":        "Uint64",
+	"float32":       "Float32",
+	"float64":       "Float64",
+	"time.Duration": "Duration",
+	"time.Time":     "Time",
+}
+
+// the zap call for a message, with a typed field per field where the type is
+// known and zap.Any otherwise
+func ZapLog(msg Message, opts Options) string {
+	imp, _ := BackendImport(opts)
+
+	logger := opts.Logger
+	if logger == "" {
+		logger = imp.Name + ".L()"
+	}
+
+	level := LevelMethod(LogLevel(msg.Event, opts))
+
+	args := []string{strconv.Quote(EventMessages[msg.Event])}
+	for _, field := range GetStructuredFields(msg, opts) {
+		typ := FieldType(field)
+
+		constructor, ok := zapFields[typ]
+		switch {
+		case typ == "error":
+			constructor = "NamedError"
+		case !ok:
+			constructor = "Any"
+		}
+
+		args = append(args, fmt.Sprintf("%s.%s(%q, %s)", imp.Name, constructor, field.Key, FieldValue(field)))
+	}
+
+	return fmt.Sprintf("%s.%s(%s)", logger, level, strings.Join(args, ", "))
+}
+
+// the methods of zerolog events adding a field of the types they take
+var zerologFields = map[string]string{
+	"string":        "Str",
+	"bool":          "Bool",
+	"int":           "Int",
+	"int8":          "Int8",
+	"int16":         "Int16",
+	"int32":         "Int32",
+	"int64":         "Int64",
+	"uint":          "Uint",
+	"uint8":         "Uint8",
+	"uint16":        "Uint16",
+	"uint32":        "Uint32",
+	"uint64":        "Uint64",
+	"float32":       "Float32",
+	"float64":       "Float64",
+	"time.Duration": "Dur",
+	"time.Time":     "Time",
+	"error":         "AnErr",
+}
+
+// the zerolog chain for a message, with a typed field per field where the
+// type is known and Interface otherwise
+func ZerologLog(msg Message, opts Options) string {
+	logger := opts.Logger
+	if logger == "" {
+		imp, _ := BackendImport(opts)
+		logger = imp.Name
+	}
+
+	level := LevelMethod(LogLevel(msg.Event, opts))
+
+	chain := []string{logger, level + "()"}
+	for _, field := range GetStructuredFields(msg, opts) {
+		method, ok := zerologFields[FieldType(field)]
+		if !ok {
+			method = "Interface"
+		}
+
+		chain = append(chain, fmt.Sprintf("%s(%q, %s)", method, field.Key, FieldValue(field)))
+	}
+
+	chain = append(chain, fmt.Sprintf("Msg(%q)", EventMessages[msg.Event]))
+	return strings.Join(chain, ".")
+}
+
+// the logrus call for a message, the fields go in a logrus.Fields map
+func LogrusLog(msg Message, opts Options) string {
+	imp, _ := BackendImport(opts)
+
+	logger := opts.Logger
+	if logger == "" {
+		logger = imp.Name
+	}
+
+	level := LevelMethod(LogLevel(msg.Event, opts))
+
+	var fields []string
+	for _, field := range GetStructuredFields(msg, opts) {
+		fields = append(fields, fmt.Sprintf("%q: %s", field.Key, FieldValue(field)))
+	}
+
+	return fmt.Sprintf("%s.WithFields(%s.Fields{%s}).%s(%q)", logger, imp.Name, strings.Join(fields, ", "), level, EventMessages[msg.Event])
+}
+
+// the printf style function of -log-call, its package renamed to the name it
+// is imported under with -log-import
+func LogCallFunc(opts Options) string {
+	imp, ok := BackendImport(opts)
+	if !ok {
+		return opts.LogCall
+	}
+
+	return imp.Name + opts.LogCall[strings.Index(opts.LogCall, "."):]
+}
+
+// RingLog keeps a log line in the ring buffer of -ring instead of writing it
+func RingLog(text string, args []string, opts Options) string {
+	if len(args) == 0 && !strings.Contains(text, "%") {
+		return fmt.Sprintf("%s.Record(%d, \"%s\")", RuntimeName, opts.Ring, text)
+	}
+
+	if len(args) == 0 {
+		return fmt.Sprintf("%s.Record(%d, fmt.Sprintf(\"%s\"))", RuntimeName, opts.Ring, text)
+	}
+
+	return fmt.Sprintf("%s.Record(%d, fmt.Sprintf(\"%s\", %s))", RuntimeName, opts.Ring, text, strings.Join(args, ","))
+}
+
+// the statement writing a log line about event, text is the format string
+// for args
+func PrintLog(event string, text string, args []string, opts Options) string {
+	// loggers end every entry with a newline themselves and have no Println
+	// to go with the function
+	if opts.LogCall != "" && len(args) == 0 {
+		return fmt.Sprintf("%s(\"%s\")", LogCallFunc(opts), text)
+	}
+
+	if opts.LogCall != "" {
+		return fmt.Sprintf("%s(\"%s\", %s)", LogCallFunc(opts), text, strings.Join(args, ","))
+	}
+
+	fn, newline, writer := "fmt.Printf", "\\n", ""
+	if imp, ok := BackendImport(opts); ok {
+		// the standard logger ends every entry with a newline itself
+		fn, newline = imp.Name+".Printf", ""
+	}
+
+	if opts.Output != "" || opts.Color != "" || opts.Async > 0 {
+		fn, writer = "fmt.Fprintf", fmt.Sprintf("%s.Output(%q, %d)", RuntimeName, opts.Output, opts.RotateMB)
+
+		if opts.Async > 0 {
+			writer = fmt.Sprintf("%s.Async(%s, %d, %t)", RuntimeName, writer, opts.Async, opts.AsyncDrop)
+		}
+
+		if opts.Color != "" {
+			writer = fmt.Sprintf("%s.Color(%q, %q, %s)", RuntimeName, opts.Color, event, writer)
+		}
+
+		writer += ", "
+	}
+
+	// without verbs there is nothing to format, escaped percent signs would
+	// be printed doubled by Println
+	if len(args) == 0 && !strings.Contains(text, "%") {
+		return fmt.Sprintf("%s(%s\"%s\")", strings.TrimSuffix(fn, "f")+"ln", writer, text)
+	}
+
+	if len(args) == 0 {
+		return fmt.Sprintf("%s(%s\"%s%s\")", fn, writer, text, newline)
+	}
+
+	return fmt.Sprintf("%s(%s\"%s%s\", %s)", fn, writer, text, newline, strings.Join(args, ","))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+)
+
+// make sure tag can be used on its own in a //go:build line
+func CheckBuildTag(tag string) error {
+	expr, err := constraint.Parse("//go:build " + tag)
+	if err != nil {
+		return fmt.Errorf("invalid -build-tag %q: %w", tag, err)
+	}
+
+	_, ok := expr.(*constraint.TagExpr)
+	if !ok {
+		return fmt.Errorf("invalid -build-tag %q, must be a single tag", tag)
+	}
+
+	return nil
+}
+
+// drop a guard added by an earlier run, so guarding twice does not stack up.
+// Returns nil if the guard was all there was.
+func UnguardExpr(expr constraint.Expr, tag string) constraint.Expr {
+	isGuard := func(x constraint.Expr) bool {
+		if not, ok := x.(*constraint.NotExpr); ok {
+			x = not.X
+		}
+
+		t, ok := x.(*constraint.TagExpr)
+		return ok && t.Tag == tag
+	}
+
+	if isGuard(expr) {
+		return nil
+	}
+
+	// the guard comes first, && chains parse into the left operand
+	and, ok := expr.(*constraint.AndExpr)
+	if !ok {
+		return expr
+	}
+
+	x := UnguardExpr(and.X, tag)
+	if x == nil {
+		return and.Y
+	}
+
+	if x != and.X {
+		return &constraint.AndExpr{X: x, Y: and.Y}
+	}
+
+	return expr
+}
+
+// GuardLines returns a copy of contents whose //go:build constraint requires
+// tag (or !tag when negate is set) on top of what the file required before.
+// pkgLine is the line of the package clause, constraints can only precede it.
+// The number of lines stays the same so the logs still line up, and the
+// constraint stays where it was, so the blank line separating it from the
+// package clause or its doc comment does too.
+func GuardLines(contents []string, pkgLine int, tag string, negate bool) ([]string, error) {
+	var guard constraint.Expr = &constraint.TagExpr{Tag: tag}
+	if negate {
+		guard = &constraint.NotExpr{X: guard}
+	}
+
+	guarded := make([]string, len(contents))
+	copy(guarded, contents)
+
+	buildLine := -1
+	var plusLines []int
+	for idx := 0; idx < len(guarded) && idx < pkgLine-1; idx++ {
+		line := strings.TrimSpace(guarded[idx])
+
+		switch {
+		case constraint.IsGoBuild(line):
+			buildLine = idx
+		case constraint.IsPlusBuild(line):
+			plusLines = append(plusLines, idx)
+		}
+	}
+
+	// //go:build wins over // +build lines since go 1.17, but a file with only
+	// the latter still needs what they say
+	exprLines := plusLines
+	if buildLine >= 0 {
+		exprLines = []int{buildLine}
+	}
+
+	var expr constraint.Expr
+	for _, idx := range exprLines {
+		x, err := constraint.Parse(strings.TrimSpace(guarded[idx]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", idx+1, err)
+		}
+
+		if expr == nil {
+			expr = x
+		} else {
+			expr = &constraint.AndExpr{X: expr, Y: x}
+		}
+	}
+
+	if expr != nil {
+		expr = UnguardExpr(expr, tag)
+	}
+
+	if expr != nil {
+		guard = &constraint.AndExpr{X: guard, Y: expr}
+	}
+
+	goBuild := "//go:build " + guard.String()
+
+	// the // +build lines are rewritten to say the same as //go:build, the
+	// way gofmt keeps them in sync, so vet does not complain about the two
+	// disagreeing
+	if len(plusLines) != 0 {
+		lines, err := constraint.PlusBuildLines(guard)
+		if err != nil {
+			lines = nil
+		}
+
+		// a file without //go:build gets it where its first // +build line was
+		if buildLine < 0 {
+			lines = append([]string{goBuild}, lines...)
+		}
+
+		for i, idx := range plusLines {
+			guarded[idx] = ""
+			switch {
+			case i == len(plusLines)-1 && i < len(lines):
+				guarded[idx] = strings.Join(lines[i:], "\n")
+			case i < len(lines):
+				guarded[idx] = lines[i]
+			}
+		}
+
+		if buildLine < 0 {
+			return guarded, nil
+		}
+	}
+
+	if buildLine < 0 {
+		if len(guarded) == 0 {
+			return guarded, nil
+		}
+
+		guarded[0] = fmt.Sprintf("%s\n\n%s", goBuild, guarded[0])
+		return guarded, nil
+	}
+
+	guarded[buildLine] = goBuild
+	return guarded, nil
+}
+
+// GuardSource is src with the constraint of GuardLines requiring tag
+func GuardSource(src []byte, tag string) ([]byte, error) {
+	fset := token.NewFileSet()
+
+	root, err := parser.ParseFile(fset, "", src, parser.PackageClauseOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := ReadLines(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	guarded, err := GuardLines(contents, fset.PositionFor(root.Package, false).Line, tag, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(JoinLines(guarded)), nil
+}
+
+// rewrite the original file with its negated guard, so it drops out of the
+// build whenever the instrumented copy is selected
+func GuardOriginal(filePath string, guarded []string, opts Options) error {
+	src, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	opts.LineStyle = GetLineStyle(src)
+
+	if string(src) == string(opts.LineStyle.Apply([]byte(strings.Join(guarded, "\n")+"\n"))) {
+		return nil
+	}
+
+	if opts.Backup {
+		err = WriteBackup(filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return WriteLinesToFile(filePath, filePath, guarded, opts)
+}
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type Command struct {
+	Name  string
+	Args  string // usage synopsis after the command name
+	Short string
+	Run   func(cmd *Command, args []string) error
+}
+
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{
+			Name:  "instrument",
+			Args:  "[flags] [path ...]",
+			Short: "inject entry and exit logs into the given files, directories or packages",
+			Run:   RunInstrument,
+		},
+		{
+			Name:  "strip",
+			Args:  "[flags] [path ...]",
+			Short: "remove previously injected logs, restoring the files in place",
+			Run:   RunStrip,
+		},
+		{
+			Name:  "watch",
+			Args:  "[flags] [path ...]",
+			Short: "instrument the given paths and re-instrument files whenever they change",
+			Run:   RunWatch,
+		},
+		{
+			Name:  "run",
+			Args:  "[flags] package [arguments ...]",
+			Short: "instrument a package into a temporary overlay and go run it",
+			Run:   RunRun,
+		},
+		{
+			Name:  "test",
+			Args:  "[flags] [packages] [go test flags]",
+			Short: "instrument packages into a temporary overlay and go test them",
+			Run:   RunTest,
+		},
+		{
+			Name:  "build",
+			Args:  "[flags] [packages] [go build flags]",
+			Short: "instrument packages into a temporary overlay and go build a debug binary",
+			Run:   RunBuild,
+		},
+		{
+			Name:  "list",
+			Args:  "[flags] [path ...]",
+			Short: "list the functions that would be instrumented",
+			Run:   RunList,
+		},
+		{
+			Name:  "report",
+			Args:  "[flags] [path ...]",
+			Short: "summarize how many functions and logs instrumenting would touch",
+			Run:   RunReport,
+		},
+	}
+}
+
+func ProgramName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func FindCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [path ...]\n\n", ProgramName())
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.Name, cmd.Short)
+	}
+
+	fmt.Fprintf(w, "\nrun '%s help <command>' for the flags of a command\n", ProgramName())
+	fmt.Fprintln(w, "without a command the arguments are handed to instrument")
+}
+
+// every command gets its own flag set and help output
+func NewFlagSet(cmd *Command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.Name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s %s\n\n%s\n", ProgramName(), cmd.Name, cmd.Args, cmd.Short)
+		fmt.Fprintln(fs.Output(), "a path of - reads the source from stdin")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+
+	fs.String("config", "", "read flag defaults from this `file` instead of the nearest .gofunclogger.yaml, none disables it")
+	fs.String("files", "", "also process the newline separated paths listed in this file (`@list.txt`), - reads them from stdin")
+	return fs
+}
+
+func AddFilterFlags(fs *flag.FlagSet, filter *FileFilter) {
+	fs.Var(&filter.Include, "include", "only instrument walked files matching this `glob` (repeatable)")
+	fs.Var(&filter.Exclude, "exclude", "skip walked files and directories matching this `glob`, e.g. '*_gen.go' (repeatable)")
+	fs.BoolVar(&filter.Generated, "generated", false, "also instrument walked files marked as generated (// Code generated ... DO NOT EDIT.)")
+	fs.BoolVar(&filter.Vendor, "vendor", false, "walk into vendor directories")
+	fs.BoolVar(&filter.Testdata, "testdata", false, "walk into testdata directories")
+	fs.BoolVar(&filter.Hidden, "hidden", false, "walk into hidden directories (names starting with a dot)")
+}
+
+// flags deciding which functions get instrumented, shared with list and report
+func AddSelectFlags(fs *flag.FlagSet, opts *Options) {
+	fs.BoolVar(&opts.Goroutines, "goroutines", false, "also instrument func literals started with go func() {...}()")
+	fs.BoolVar(&opts.Defers, "defers", false, "also instrument func literals run with defer func() {...}()")
+	fs.StringVar(&opts.Interface, "interface", "", "only instrument the methods implementing this interface, e.g. io.Reader or example.com/pkg.Store (needs type checking)")
+	fs.BoolVar(&opts.Filter.Tests, "tests", false, "also instrument _test.go files and the subtests started with t.Run, logging t.Name()")
+	AddFilterFlags(fs, &opts.Filter)
+}
+
+// flags given on the command line win over the ones from the config file
+func ParseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	paths, err := ParseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		fs.Usage()
+		return nil, &UsageError{Msg: "no paths given"}
+	}
+
+	return paths, nil
+}
+
+// like ParseArgs, for commands that can do without paths
+func ParseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.Parse(args)
+
+	err := LoadConfig(fs)
+	if err != nil {
+		return nil, &UsageError{Msg: err.Error()}
+	}
+
+	paths := fs.Args()
+
+	manifest := fs.Lookup("files").Value.String()
+	if manifest != "" {
+		listed, err := ReadManifest(manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			if path == "-" && manifest == "-" {
+				return nil, &UsageError{Msg: "-files - and a - path cannot both read stdin"}
+			}
+		}
+
+		paths = append(paths, listed...)
+	}
+
+	return paths, nil
+}
+
+// ReadManifest reads a newline separated list of paths from a response file,
+// named either as @file or plain file, or from stdin for -. Blank lines and
+// lines starting with # are ignored.
+func ReadManifest(name string) ([]string, error) {
+	var r io.Reader
+
+	if name == "-" {
+		r = os.Stdin
+	} else {
+		file, err := os.Open(strings.TrimPrefix(name, "@"))
+		if err != nil {
+			return nil, err
+		}
+
+		defer file.Close()
+		r = file
+	}
+
+	lines, err := ReadLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		paths = append(paths, line)
+	}
+
+	return paths, nil
+}
+
+func RunCLI(args []string) error {
+	if len(args) == 0 {
+		Usage(os.Stderr)
+		return &UsageError{Msg: "no command given"}
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			cmd := FindCommand(args[1])
+			if cmd == nil {
+				return &UsageError{Msg: fmt.Sprintf("unknown command %q", args[1])}
+			}
+
+			return cmd.Run(cmd, []string{"-h"})
+		}
+
+		Usage(os.Stdout)
+		return nil
+	}
+
+	cmd := FindCommand(args[0])
+	if cmd == nil {
+		// keep `gofunclogger [flags] <path>` working
+		cmd = FindCommand("instrument")
+	} else {
+		args = args[1:]
+	}
+
+	return cmd.Run(cmd, args)
+}
+
+func AddInstrumentFlags(fs *flag.FlagSet, opts *Options) {
+	fs.BoolVar(&opts.InPlace, "w", false, "write result to (source) file instead of a debug_ copy")
+	fs.BoolVar(&opts.Backup, "backup", true, "with -w, save the original file as <file>.orig")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print a unified diff of the injected logs instead of writing any file")
+	fs.StringVar(&opts.OutDir, "outdir", "", "write instrumented files into a mirrored directory tree rooted at `dir`")
+	fs.StringVar(&opts.NameTemplate, "name-template", DefaultNameTemplate, "text/template `tmpl` naming the instrumented copy, with {{.Name}}, {{.Base}} and {{.Ext}}")
+	fs.StringVar(&opts.BuildTag, "build-tag", "", "guard the instrumented copy with //go:build `tag` and the original with !tag, so -tags tag switches between them")
+	fs.Var(&opts.Deps, "dep", "copy the module providing this `package` into "+DepDir+"/, replace it in go.mod and instrument it (repeatable)")
+	fs.Var(&opts.Std, "std", "with -overlay, also instrument this standard library `package` (repeatable)")
+	fs.StringVar(&opts.Overlay, "overlay", "", "instrument into a temporary directory and write a go build -overlay `file` (- for stdout) instead of touching the tree")
+	fs.BoolVar(&opts.KeepMtime, "keep-mtime", false, "give written files the modification time of the file they were made from")
+	fs.IntVar(&opts.Jobs, "jobs", runtime.NumCPU(), "number of files to instrument concurrently")
+	fs.StringVar(&opts.Since, "since", "", "only instrument functions whose bodies changed relative to this git `ref`, - reads a unified diff from stdin")
+	fs.BoolVar(&opts.Interactive, "interactive", false, "pick the functions to instrument from a list in the terminal")
+	fs.StringVar(&opts.IfInstrumented, "if-instrumented", IfInstrumentedSkip, "what to do with files that already contain injected logs: skip, refresh or error")
+	AddSelectFlags(fs, opts)
+	AddLogFlags(fs, opts)
+}
+
+// AddLogFlags registers the flags shaping the injected logs, shared by every
+// command that instruments
+func AddLogFlags(fs *flag.FlagSet, opts *Options) {
+	fs.BoolVar(&opts.LogReceiver, "log-receiver", false, "log the receiver value of methods alongside their parameters")
+	fs.StringVar(&opts.ReceiverFormat, "receiver-format", ReceiverValue, "how -log-receiver prints the receiver: value, exported (only exported fields), type or pointer")
+	fs.BoolVar(&opts.Timestamps, "timestamps", false, "prefix every log with the time it was written at")
+	fs.BoolVar(&opts.GoroutineID, "goroutine-id", false, "prefix every log with the id of the goroutine writing it")
+	fs.BoolVar(&opts.Durations, "time", false, "log how long the function ran at every exit")
+	fs.BoolVar(&opts.Caller, "caller", false, "log the function and file:line a function was called from on entry")
+	fs.BoolVar(&opts.Qualified, "qualified", false, "qualify the function names in the logs with their package name, e.g. store.(*DB).Get")
+	fs.BoolVar(&opts.CallIDs, "call-id", false, "number every call and log the number on entry and exit, to pair them up in recursive and concurrent calls")
+	fs.BoolVar(&opts.CountCalls, "count-calls", false, "count the calls of every function and log the count on entry, e.g. (call #3)")
+	fs.BoolVar(&opts.Indent, "indent", false, "indent the logs by the call depth of their goroutine, so nested calls read like a tree")
+	fs.IntVar(&opts.MaxValueLen, "max-value-len", 0, "cut logged parameter, receiver and result values longer than this many characters, 0 for no limit")
+	fs.Var(&opts.Redact, "redact", "log [REDACTED] instead of the value of parameters and results whose name matches this case insensitive `glob` (repeatable), replaces the default *password*, *secret*, *token*, ... patterns")
+	fs.Var(&opts.SkipTypes, "skip-type", "log only the type of parameters and results of this `type` as written in the source, chan and func match all channel and function types (repeatable), replaces the default context.Context, sync types, chan and func")
+	fs.BoolVar(&opts.Deref, "deref", false, "log what pointer parameters, receivers and results point to instead of their address, <nil> for nil pointers")
+	fs.StringVar(&opts.Backend, "backend", BackendFmt, "what the logs are written with: fmt (stdout), log (the standard logger), slog (the default slog logger), zap (zap.L() or -logger), zerolog (the global logger or -logger) or logrus (the standard logger or -logger), the last four at debug level or -level")
+	fs.StringVar(&opts.Logger, "logger", "", "Go `expression` of the logger -backend zap, zerolog or logrus writes to, e.g. myapp.Log, instead of their global one; it has to be valid in every instrumented file")
+	fs.StringVar(&opts.LogCall, "log-call", "", "printf style `function` writing the logs instead of -backend, e.g. mypkg.Logger.Debugf")
+	fs.StringVar(&opts.LogImport, "log-import", "", "import `path` of the package -log-call starts with, imported under a name of its own")
+	fs.StringVar(&opts.Output, "output", "", "where -backend fmt writes the logs to: stdout, stderr or a file `path` to append to, through the runtime; FUNCLOG_OUTPUT overrides it when the program runs")
+	fs.StringVar(&opts.Color, "color", "", "color the logs of -backend fmt when they go to a terminal: event (green entries, blue exits, red panics) or goroutine (a hue per goroutine); FUNCLOG_COLOR=always or never and NO_COLOR override the terminal check")
+	fs.IntVar(&opts.Async, "async", 0, "queue up to this many logs of -backend fmt for a goroutine to write, so a log costs formatting and a channel send; main flushes the queue before the program ends, other programs call funclog.Flush or funclog.Close")
+	fs.BoolVar(&opts.AsyncDrop, "async-drop", false, "drop logs when the -async queue is full instead of waiting for room, and count them")
+	fs.IntVar(&opts.RotateMB, "rotate-mb", 0, "rotate the -output file once it grows past this many megabytes, keeping 5 old ones; FUNCLOG_ROTATE_MB overrides it")
+	fs.StringVar(&opts.Level, "level", "", "log at this level, debug, info, warn or error, and only write the logs when the FUNCLOG_LEVEL environment variable of the program lets it through (info by default); panics are errors")
+	fs.BoolVar(&opts.KillSwitch, "kill-switch", false, "only write the logs when the program runs with GOFUNCLOG=1, otherwise they cost a check of a flag read once at startup")
+	fs.BoolVar(&opts.Signals, "signals", false, "turn logging on and off when the program gets SIGUSR1 and write the call counts and toggles of every function to stderr on SIGUSR2; logging starts on unless -kill-switch or GOFUNCLOG say otherwise")
+	fs.IntVar(&opts.Sample, "sample", 0, "only log 1 in this many calls of every function, the first, the N+1th, ...; entry and exit logs of a call are written together or not at all")
+	fs.IntVar(&opts.RateLimit, "rate-limit", 0, "let every function write at most this many entry and exit logs per second, in bursts of as many; the logs dropped are counted and reported on stderr every second")
+	fs.BoolVar(&opts.LineDirectives, "line-directives", false, "put //line directives into the instrumented copy, so panics, stack traces and debuggers show the positions of the original file")
+	fs.Var(&opts.SampleFuncs, "sample-func", "log 1 in N calls of the functions whose name, with or without the package, matches the glob of `NAME=N` instead of -sample (repeatable, the last match wins), e.g. 'store.(*DB).*=100'; N of 1 logs every call")
+	fs.BoolVar(&opts.FuncToggles, "func-toggles", false, "let the program turn the logs of single functions on and off while it runs, with the FUNCLOG_FUNCS environment variable or funclog.Enable and funclog.Disable")
+	fs.BoolVar(&opts.HTTPHandler, "http-handler", false, "also copy funcloghttp, an http.Handler to inspect and change the runtime with, next to the runtime for the program to mount")
+	fs.IntVar(&opts.Ring, "ring", 0, "keep the last this many entry and exit logs in memory instead of writing them and dump them to stderr when a panic passes an instrumented function, like a flight recorder")
+	fs.StringVar(&opts.Format, "format", FormatText, "how the logs are written: text (a sentence), kv (key=value fields), json (an object per log) or logfmt")
+	fs.StringVar(&opts.ProcessInfo, "process-info", "", "describe the process the logs come from (pid, host, module version and VCS revision): once, in a log of its own, or every, in front of every log")
+	fs.StringVar(&opts.EntryTemplate, "entry-template", DefaultEntryTemplate, "text/template `tmpl` for the start of entry logs, with {{.Func}}, {{.Name}}, {{.Package}}, {{.File}}, {{.Line}}, {{.Params}} and {{.Results}}")
+	fs.StringVar(&opts.ExitTemplate, "exit-template", DefaultExitTemplate, "text/template `tmpl` for the start of exit logs, with the fields of -entry-template")
+	fs.BoolVar(&opts.ExitErrors, "exit-errors", false, "log the exits of functions whose last result is an error only when it is non-nil")
+	fs.BoolVar(&opts.NameParams, "name-params", false, "name unnamed parameters arg0, arg1, ... in the instrumented copy so their values can be logged")
+	fs.BoolVar(&opts.Recover, "recover", false, "log panics escaping a function with a stack trace before passing them on")
+}
+
+// LoadInstrumentOptions validates opts and resolves what has to be computed
+// before any file is touched
+func LoadInstrumentOptions(opts *Options, paths []string) error {
+	err := CheckInstrumentOptions(*opts)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if path == "-" && (opts.Since != "" || opts.Interactive || opts.Overlay != "" || opts.BuildTag != "" || opts.Interface != "" || opts.LineDirectives) {
+			return &UsageError{Msg: "-since, -interactive, -overlay, -build-tag, -interface and -line-directives cannot be used when reading the source from stdin"}
+		}
+	}
+
+	if opts.Since != "" {
+		opts.Changes, err = LoadChanges(opts.Since)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = LoadRuntime(opts, paths)
+	if err != nil {
+		return err
+	}
+
+	return LoadSelection(opts, paths)
+}
+
+func CheckInstrumentOptions(opts Options) error {
+	if opts.InPlace && opts.OutDir != "" {
+		return &UsageError{Msg: "-w and -outdir cannot be used together"}
+	}
+
+	if opts.Overlay != "" && (opts.InPlace || opts.OutDir != "" || opts.DryRun) {
+		return &UsageError{Msg: "-overlay cannot be combined with -w, -outdir or -dry-run"}
+	}
+
+	if len(opts.Deps) > 0 && (opts.Overlay != "" || opts.DryRun || opts.Interactive) {
+		return &UsageError{Msg: "-dep cannot be combined with -overlay, -dry-run or -interactive"}
+	}
+
+	err := CheckNameTemplate(opts.NameTemplate)
+	if err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+
+	if opts.BuildTag != "" {
+		err = CheckBuildTag(opts.BuildTag)
+		if err != nil {
+			return &UsageError{Msg: err.Error()}
+		}
+
+		// the copy has to live next to the original to take its place
+		if opts.InPlace || opts.OutDir != "" || opts.Overlay != "" {
+			return &UsageError{Msg: "-build-tag cannot be combined with -w, -outdir or -overlay"}
+		}
+	}
+
+	err = CheckMessageTemplate("entry-template", opts.EntryTemplate)
+	if err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+
+	err = CheckMessageTemplate("exit-template", opts.ExitTemplate)
+	if err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+
+	switch opts.IfInstrumented {
+	case IfInstrumentedSkip, IfInstrumentedRefresh, IfInstrumentedError:
+	default:
+		return &UsageError{Msg: fmt.Sprintf("invalid -if-instrumented %q, must be skip, refresh or error", opts.IfInstrumented)}
+	}
+
+	switch opts.Backend {
+	case BackendFmt, BackendLog, BackendSlog, BackendZap, BackendZerolog, BackendLogrus:
+	default:
+		return &UsageError{Msg: fmt.Sprintf("invalid -backend %q, must be fmt, log, slog, zap, zerolog or logrus", opts.Backend)}
+	}
+
+	if opts.Logger != "" && opts.Backend != BackendZap && opts.Backend != BackendZerolog && opts.Backend != BackendLogrus {
+		return &UsageError{Msg: "-logger needs -backend zap, zerolog or logrus"}
+	}
+
+	if opts.LogCall != "" && opts.Backend != BackendFmt {
+		return &UsageError{Msg: "-log-call cannot be combined with -backend"}
+	}
+
+	if opts.Output != "" && (opts.Backend != BackendFmt || opts.LogCall != "") {
+		return &UsageError{Msg: "-output only applies to -backend fmt, the other backends and -log-call write where their logger does"}
+	}
+
+	switch opts.Color {
+	case "", ColorEvent, ColorGoroutine:
+	default:
+		return &UsageError{Msg: fmt.Sprintf("invalid -color %q, must be event or goroutine", opts.Color)}
+	}
+
+	if opts.Color != "" && (opts.Backend != BackendFmt || opts.LogCall != "") {
+		return &UsageError{Msg: "-color only applies to -backend fmt"}
+	}
+
+	if opts.Async < 0 {
+		return &UsageError{Msg: "-async must not be negative"}
+	}
+
+	if opts.Async > 0 && (opts.Backend != BackendFmt || opts.LogCall != "") {
+		return &UsageError{Msg: "-async only applies to -backend fmt"}
+	}
+
+	if opts.AsyncDrop && opts.Async == 0 {
+		return &UsageError{Msg: "-async-drop needs -async"}
+	}
+
+	if opts.RotateMB < 0 || opts.RotateMB > 0 && opts.Output == "" {
+		return &UsageError{Msg: "-rotate-mb needs -output and must not be negative"}
+	}
+
+	if opts.LogImport != "" && !strings.Contains(opts.LogCall, ".") {
+		return &UsageError{Msg: "-log-import needs a -log-call starting with the package, e.g. mypkg.Debugf"}
+	}
+
+	if opts.Ring < 0 {
+		return &UsageError{Msg: "-ring must not be negative"}
+	}
+
+	if opts.Ring > 0 && (opts.Backend != BackendFmt || opts.LogCall != "") {
+		return &UsageError{Msg: "-ring only applies to -backend fmt, the runtime keeps the formatted lines"}
+	}
+
+	if opts.RateLimit < 0 {
+		return &UsageError{Msg: "-rate-limit must not be negative"}
+	}
+
+	if opts.Sample < 0 {
+		return &UsageError{Msg: "-sample must not be negative"}
+	}
+
+	switch opts.Level {
+	case "", LevelDebug, LevelInfo, LevelWarn, LevelError:
+	default:
+		return &UsageError{Msg: fmt.Sprintf("invalid -level %q, must be debug, info, warn or error", opts.Level)}
+	}
+
+	switch opts.Format {
+	case FormatText, FormatKV, FormatJSON, FormatLogfmt:
+	default:
+		return &UsageError{Msg: fmt.Sprintf("invalid -format %q, must be text, kv, json or logfmt", opts.Format)}
+	}
+
+	switch opts.ProcessInfo {
+	case "", ProcessInfoOnce, ProcessInfoEvery:
+	default:
+		return &UsageError{Msg: fmt.Sprintf("invalid -process-info %q, must be once or every", opts.ProcessInfo)}
+	}
+
+	switch opts.ReceiverFormat {
+	case ReceiverValue, ReceiverExported, ReceiverType, ReceiverPointer:
+	default:
+		return &UsageError{Msg: fmt.Sprintf("invalid -receiver-format %q, must be value, exported, type or pointer", opts.ReceiverFormat)}
+	}
+
+	if opts.MaxValueLen < 0 {
+		return &UsageError{Msg: fmt.Sprintf("invalid -max-value-len %d, must not be negative", opts.MaxValueLen)}
+	}
+
+	// the standard library can't import the runtime copied into the module
+	if NeedsRuntime(opts) && len(opts.Std) > 0 {
+		return &UsageError{Msg: "-std cannot be combined with options that need the funclog runtime (-timestamps, -goroutine-id, -time, -caller, -call-id, -count-calls, -indent, -max-value-len, -deref, -process-info, -format json, -format logfmt, -output, -color, -async, -level, -kill-switch, -signals, -sample, -sample-func, -rate-limit, -func-toggles, -ring, -receiver-format exported, -http-handler)"}
+	}
+
+	return nil
+}
+
+func RunInstrument(cmd *Command, args []string) error {
+	var opts Options
+
+	fs := NewFlagSet(cmd)
+	AddInstrumentFlags(fs, &opts)
+
+	paths, err := ParseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 && len(opts.Deps) == 0 && len(opts.Std) == 0 {
+		fs.Usage()
+		return &UsageError{Msg: "no paths given"}
+	}
+
+	// GOROOT is never written to
+	if len(opts.Std) > 0 && opts.Overlay == "" {
+		return &UsageError{Msg: "-std can only be used with -overlay"}
+	}
+
+	err = LoadInstrumentOptions(&opts, paths)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, dep := range opts.Deps {
+		errs = append(errs, InstrumentDependency(dep, opts))
+	}
+
+	if opts.Interactive {
+		opts.Selected, err = PickFunctions(paths, opts)
+		if err != nil {
+			return err
+		}
+
+		if len(opts.Selected) == 0 {
+			fmt.Fprintln(os.Stderr, "nothing selected")
+			return nil
+		}
+	}
+
+	if opts.Overlay != "" {
+		overlay, dir, err := BuildOverlay(paths, opts)
+		if dir != "" {
+			fmt.Fprintf(os.Stderr, "instrumented copies are in %s\n", dir)
+		}
+
+		return errors.Join(err, WriteOverlay(opts.Overlay, overlay))
+	}
+
+	if opts.RuntimeDir != "" && !opts.DryRun {
+		_, err = WriteRuntime(opts.RuntimeDir, opts)
+		errs = append(errs, err)
+	}
+
+	for _, path := range paths {
+		errs = append(errs, InstrumentPath(path, opts))
+	}
+
+	return errors.Join(errs...)
+}
+
+func RunStrip(cmd *Command, args []string) error {
+	var opts Options
+
+	fs := NewFlagSet(cmd)
+	fs.BoolVar(&opts.Backup, "backup", true, "save the original file as <file>.orig before restoring it")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print a unified diff of the removed logs instead of writing any file")
+	fs.StringVar(&opts.OutDir, "outdir", "", "write the restored files into a mirrored directory tree rooted at `dir`")
+	fs.BoolVar(&opts.KeepMtime, "keep-mtime", false, "give restored files the modification time of the file they were made from")
+	fs.IntVar(&opts.Jobs, "jobs", runtime.NumCPU(), "number of files to strip concurrently")
+	AddFilterFlags(fs, &opts.Filter)
+
+	paths, err := ParseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// test files only contain logs if they were instrumented on purpose
+	opts.Filter.Tests = true
+
+	var errs []error
+	for _, path := range paths {
+		errs = append(errs, StripPath(path, opts))
+	}
+
+	return errors.Join(errs...)
+}
+
+func AddWatchFlags(fs *flag.FlagSet, interval *time.Duration) {
+	fs.DurationVar(interval, "interval", 100*time.Millisecond, "how long to wait for more changes after a file changed before instrumenting")
+}
+
+func RunWatch(cmd *Command, args []string) error {
+	var opts Options
+	var interval time.Duration
+
+	fs := NewFlagSet(cmd)
+	AddInstrumentFlags(fs, &opts)
+	AddWatchFlags(fs, &interval)
+
+	paths, err := ParseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// rewriting the sources would trigger the next round on our own output
+	if opts.InPlace {
+		return &UsageError{Msg: "watch cannot be combined with -w"}
+	}
+
+	// an overlay, the picked functions and the copied dependencies are
+	// made once, they would not follow the changes
+	if opts.Overlay != "" || opts.Interactive || len(opts.Deps) != 0 {
+		return &UsageError{Msg: "watch cannot be combined with -overlay, -interactive or -dep"}
+	}
+
+	for _, path := range paths {
+		if path == "-" {
+			return &UsageError{Msg: "watch cannot read from stdin"}
+		}
+	}
+
+	err = LoadInstrumentOptions(&opts, paths)
+	if err != nil {
+		return err
+	}
+
+	if opts.RuntimeDir != "" {
+		_, err = WriteRuntime(opts.RuntimeDir, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return NewWatcher(paths, opts, interval).Run()
+}
+
+// calls fn with the parsed source of every file that path resolves to, files
+// that fail do not stop the others
+func ForEachFile(path string, filter FileFilter, fn func(filePath string, root *ast.File, fset *token.FileSet) error) error {
+	if path == "-" {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		root, fset, err := GenerateAST("<standard input>", src)
+		if err != nil {
+			return err
+		}
+
+		return fn("<standard input>", root, fset)
+	}
+
+	files, err := ResolveFiles(path, filter)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, filePath := range files {
+		root, fset, err := GenerateAST(filePath, nil)
+		if err == nil {
+			err = fn(filePath, root, fset)
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func RunList(cmd *Command, args []string) error {
+	var opts Options
+
+	fs := NewFlagSet(cmd)
+	AddSelectFlags(fs, &opts)
+
+	paths, err := ParseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	err = LoadSelection(&opts, paths)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, path := range paths {
+		errs = append(errs, ForEachFile(path, opts.Filter, func(filePath string, root *ast.File, fset *token.FileSet) error {
+			allFuncInfo, err := GetAllFuncInfo(root, fset)
+			if err != nil {
+				return err
+			}
+
+			for _, info := range FilterFuncInfo(allFuncInfo, filePath, opts) {
+				fmt.Printf("%s:%d: %s(%s) %d exit(s)\n", filePath, info.DeclPos.Line, DisplayName(info),
+					strings.Join(info.Params, ", "), len(info.ExitLogPos)+len(info.Terminations))
+			}
+
+			return nil
+		}))
+	}
+
+	return errors.Join(errs...)
+}
+
+func RunReport(cmd *Command, args []string) error {
+	var opts Options
+
+	fs := NewFlagSet(cmd)
+	AddSelectFlags(fs, &opts)
+
+	paths, err := ParseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	err = LoadSelection(&opts, paths)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	files, funcs, exits := 0, 0, 0
+	for _, path := range paths {
+		errs = append(errs, ForEachFile(path, opts.Filter, func(filePath string, root *ast.File, fset *token.FileSet) error {
+			allFuncInfo, err := GetAllFuncInfo(root, fset)
+			if err != nil {
+				return err
+			}
+
+			allFuncInfo = FilterFuncInfo(allFuncInfo, filePath, opts)
+
+			fileExits := 0
+			for _, info := range allFuncInfo {
+				fileExits += len(info.ExitLogPos) + len(info.Terminations)
+			}
+
+			fmt.Printf("%s: %d func(s), %d entry log(s), %d exit log(s)\n", filePath, len(allFuncInfo), len(allFuncInfo), fileExits)
+
+			files++
+			funcs += len(allFuncInfo)
+			exits += fileExits
+			return nil
+		}))
+	}
+
+	fmt.Printf("total: %d file(s), %d func(s), %d log(s)\n", files, funcs, funcs+exits)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ConfigNames = []string{".gofunclogger.yaml", ".gofunclogger.yml"}
+
+// Config holds flag defaults read from a .gofunclogger.yaml file. Keys are
+// flag names, so every flag can be configured. Top level keys apply to every
+// command that has such a flag, a mapping named after a command only applies
+// to that command and wins over the top level:
+//
+//	exclude:
+//	  - "*_gen.go"
+//	  - "*.pb.go"
+//	instrument:
+//	  outdir: build/debug
+//
+// Only this small subset of YAML is understood: scalars, block and flow
+// (`[a, b]`) lists and one level of nested mappings. Quoted scalars fit on one
+// line and unquote like YAML's, not Go's.
+type Config struct {
+	Path     string
+	Global   map[string][]string
+	Commands map[string]map[string][]string
+	Lines    map[string]int // where each top level key is
+}
+
+// walks up from dir to the filesystem root, an empty result means there is none
+func FindConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		for _, name := range ConfigNames {
+			path := filepath.Join(dir, name)
+
+			_, err := os.Stat(path)
+			if err == nil {
+				return path, nil
+			}
+
+			if !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+
+		dir = parent
+	}
+}
+
+type configLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// drops a # comment unless it is inside a quoted string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// the escapes of YAML double-quoted scalars with a single character, \x, \u
+// and \U take hex digits
+var yamlEscapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n", 'v': "\v",
+	'f': "\f", 'r': "\r", 'e': "\x1b", ' ': " ", '"': `"`, '/': "/", '\\': `\`,
+	'N': "\u0085", '_': "\u00a0", 'L': "\u2028", 'P': "\u2029",
+}
+
+func ParseConfigScalar(value string) (string, error) {
+	value = strings.TrimSpace(value)
+
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return unquoteDouble(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+
+		inner := value[1 : len(value)-1]
+		if strings.Contains(strings.ReplaceAll(inner, "''", ""), "'") {
+			return "", fmt.Errorf("unescaped ' in %s, write it as ''", value)
+		}
+
+		return strings.ReplaceAll(inner, "''", "'"), nil
+	}
+
+	return value, nil
+}
+
+// unquoteDouble reads a double-quoted scalar, which follows the escapes of
+// YAML rather than those of Go
+func unquoteDouble(value string) (string, error) {
+	if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+		return "", fmt.Errorf("unterminated string %s", value)
+	}
+
+	inner := value[1 : len(value)-1]
+
+	var b strings.Builder
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		if c == '"' {
+			return "", fmt.Errorf("unexpected text after the string in %s", value)
+		}
+
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i == len(inner) {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+
+		if escaped, ok := yamlEscapes[inner[i]]; ok {
+			b.WriteString(escaped)
+			continue
+		}
+
+		digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[inner[i]]
+		if digits == 0 || i+digits >= len(inner) {
+			return "", fmt.Errorf("invalid escape \\%c in %s", inner[i], value)
+		}
+
+		r, err := strconv.ParseUint(inner[i+1:i+1+digits], 16, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape \\%s in %s", inner[i:i+1+digits], value)
+		}
+
+		b.WriteRune(rune(r))
+		i += digits
+	}
+
+	return b.String(), nil
+}
+
+// a scalar or a flow list, `[a, "b"]`
+func ParseConfigValue(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") {
+		scalar, err := ParseConfigScalar(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{scalar}, nil
+	}
+
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("unterminated list %s", value)
+	}
+
+	var values []string
+
+	inner := strings.TrimSpace(value[1 : len(value)-1])
+	if inner == "" {
+		return values, nil
+	}
+
+	var quote byte
+	start := 0
+	for i := 0; i <= len(inner); i++ {
+		c := byte(',')
+		if i < len(inner) {
+			c = inner[i]
+		}
+
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			scalar, err := ParseConfigScalar(inner[start:i])
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, scalar)
+			start = i + 1
+		}
+	}
+
+	return values, nil
+}
+
+func splitConfigKey(line configLine) (string, string, error) {
+	key, value, ok := strings.Cut(line.text, ":")
+	if !ok || strings.TrimSpace(key) == "" {
+		return "", "", fmt.Errorf("line %d: expected key: value", line.num)
+	}
+
+	return strings.TrimSpace(key), strings.TrimSpace(value), nil
+}
+
+// parses the block of lines indented deeper than indent starting at lines[i],
+// either a list or a mapping, and returns the index of the first line after it
+func parseConfigBlock(lines []configLine, i int, indent int, allowMapping bool) ([]string, map[string][]string, int, error) {
+	if i >= len(lines) || lines[i].indent <= indent {
+		return nil, nil, i, nil
+	}
+
+	blockIndent := lines[i].indent
+
+	if strings.HasPrefix(lines[i].text, "- ") || lines[i].text == "-" {
+		var values []string
+		for ; i < len(lines) && lines[i].indent > indent; i++ {
+			line := lines[i]
+			if line.indent != blockIndent || !(strings.HasPrefix(line.text, "- ") || line.text == "-") {
+				return nil, nil, i, fmt.Errorf("line %d: expected a list item", line.num)
+			}
+
+			scalar, err := ParseConfigScalar(strings.TrimPrefix(line.text, "-"))
+			if err != nil {
+				return nil, nil, i, fmt.Errorf("line %d: %w", line.num, err)
+			}
+
+			values = append(values, scalar)
+		}
+
+		return values, nil, i, nil
+	}
+
+	if !allowMapping {
+		return nil, nil, i, fmt.Errorf("line %d: mappings can only be nested one level deep", lines[i].num)
+	}
+
+	mapping := make(map[string][]string)
+	for i < len(lines) && lines[i].indent > indent {
+		line := lines[i]
+		if line.indent != blockIndent {
+			return nil, nil, i, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+
+		key, value, err := splitConfigKey(line)
+		if err != nil {
+			return nil, nil, i, err
+		}
+
+		i++
+		if value != "" {
+			mapping[key], err = ParseConfigValue(value)
+			if err != nil {
+				return nil, nil, i, fmt.Errorf("line %d: %w", line.num, err)
+			}
+
+			continue
+		}
+
+		mapping[key], _, i, err = parseConfigBlock(lines, i, line.indent, false)
+		if err != nil {
+			return nil, nil, i, err
+		}
+	}
+
+	return nil, mapping, i, nil
+}
+
+func ParseConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var lines []configLine
+
+	contents, err := ReadLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, raw := range contents {
+		num := idx + 1
+		text := strings.TrimRight(stripComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%s:%d: tabs are not allowed for indentation", path, num)
+		}
+
+		lines = append(lines, configLine{num: num, indent: len(text) - len(trimmed), text: trimmed})
+	}
+
+	config := &Config{
+		Path:     path,
+		Global:   make(map[string][]string),
+		Commands: make(map[string]map[string][]string),
+		Lines:    make(map[string]int),
+	}
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if line.indent != 0 {
+			return nil, fmt.Errorf("%s:%d: unexpected indentation", path, line.num)
+		}
+
+		key, value, err := splitConfigKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%w", path, err)
+		}
+
+		config.Lines[key] = line.num
+
+		i++
+		if value != "" {
+			config.Global[key], err = ParseConfigValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line.num, err)
+			}
+
+			continue
+		}
+
+		var values []string
+		var mapping map[string][]string
+
+		values, mapping, i, err = parseConfigBlock(lines, i, line.indent, true)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%w", path, err)
+		}
+
+		if mapping != nil {
+			config.Commands[key] = mapping
+		} else {
+			config.Global[key] = values
+		}
+	}
+
+	return config, nil
+}
+
+// Check reports the top level keys that are neither a flag of any command nor
+// a command, a misspelled key would otherwise be silently ignored
+func (c *Config) Check() error {
+	var keys []string
+	for key := range c.Lines {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return c.Lines[keys[i]] < c.Lines[keys[j]]
+	})
+
+	var errs []error
+	for _, key := range keys {
+		_, isCommand := c.Commands[key]
+
+		switch {
+		case isCommand && FindCommand(key) == nil:
+			errs = append(errs, fmt.Errorf("%s:%d: unknown command %q", c.Path, c.Lines[key], key))
+		case !isCommand && !IsFlagName(key):
+			errs = append(errs, fmt.Errorf("%s:%d: unknown key %q, not a flag of any command", c.Path, c.Lines[key], key))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// IsFlagName reports whether any command has a flag called name
+func IsFlagName(name string) bool {
+	var opts Options
+	var deps bool
+	var interval time.Duration
+	var output string
+
+	adders := []func(fs *flag.FlagSet){
+		func(fs *flag.FlagSet) { AddInstrumentFlags(fs, &opts) },
+		func(fs *flag.FlagSet) { AddGoToolFlags(fs, &opts, &deps) },
+		func(fs *flag.FlagSet) { AddWatchFlags(fs, &interval) },
+		func(fs *flag.FlagSet) { AddBuildFlags(fs, &output) },
+	}
+
+	for _, add := range adders {
+		fs := NewFlagSet(&Command{})
+		add(fs)
+
+		if fs.Lookup(name) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply sets every flag of fs that was not given on the command line from the
+// config, command specific values win over the top level ones
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	values := make(map[string][]string)
+	for key, value := range c.Global {
+		// top level keys may belong to another command
+		if fs.Lookup(key) != nil {
+			values[key] = value
+		}
+	}
+
+	for key, value := range c.Commands[fs.Name()] {
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("%s: %s has no flag named %q", c.Path, fs.Name(), key)
+		}
+
+		values[key] = value
+	}
+
+	for key, value := range values {
+		if set[key] || key == "config" {
+			continue
+		}
+
+		for _, v := range value {
+			err := fs.Set(key, v)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", c.Path, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadConfig applies the file named by -config, or the nearest config file
+// above the working directory, to fs
+func LoadConfig(fs *flag.FlagSet) error {
+	path := fs.Lookup("config").Value.String()
+	if path == "none" {
+		return nil
+	}
+
+	if path == "" {
+		var err error
+
+		path, err = FindConfig(".")
+		if err != nil || path == "" {
+			return err
+		}
+	}
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		return err
+	}
+
+	err = config.Check()
+	if err != nil {
+		return err
+	}
+
+	return config.Apply(fs)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, src string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), ConfigNames[0])
+
+	err := os.WriteFile(path, []byte(src), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		global   map[string][]string
+		commands map[string]map[string][]string
+		err      string
+	}{
+		{
+			name:   "scalars and comments",
+			src:    "---\n# the copies\noutdir: build # next to the sources\nname-template: debug_{{.Name}}\n\njobs: 4\n",
+			global: map[string][]string{"outdir": {"build"}, "name-template": {"debug_{{.Name}}"}, "jobs": {"4"}},
+		},
+		{
+			name:   "double quotes",
+			src:    `exclude: "a\tb \"c\" \x41\u00e9\/ # kept" # dropped` + "\n",
+			global: map[string][]string{"exclude": {"a\tb \"c\" Aé/ # kept"}},
+		},
+		{
+			name:   "single quotes",
+			src:    `exclude: 'it''s \n # kept'` + "\n",
+			global: map[string][]string{"exclude": {`it's \n # kept`}},
+		},
+		{
+			name:   "block list",
+			src:    "exclude:\n  - \"*_gen.go\"\n  - '*.pb.go'\n  - plain # comment\n",
+			global: map[string][]string{"exclude": {"*_gen.go", "*.pb.go", "plain"}},
+		},
+		{
+			name:   "flow list",
+			src:    `exclude: [a, "b, c", 'd''e', "f\"g", 'h, i']` + "\n",
+			global: map[string][]string{"exclude": {"a", "b, c", "d'e", `f"g`, "h, i"}},
+		},
+		{
+			name:   "empty flow list",
+			src:    "exclude: []\n",
+			global: map[string][]string{"exclude": nil},
+		},
+		{
+			name:   "command mapping",
+			src:    "outdir: a\ninstrument:\n    outdir: b\n    exclude:\n      - x.go\n    include: [y.go]\n",
+			global: map[string][]string{"outdir": {"a"}},
+			commands: map[string]map[string][]string{
+				"instrument": {"outdir": {"b"}, "exclude": {"x.go"}, "include": {"y.go"}},
+			},
+		},
+		{name: "tab indentation", src: "instrument:\n\toutdir: b\n", err: ":2: tabs are not allowed"},
+		{name: "indented top level key", src: "  outdir: b\n", err: ":1: unexpected indentation"},
+		{name: "misaligned mapping", src: "instrument:\n  outdir: b\n    jobs: 2\n", err: "line 3: unexpected indentation"},
+		{name: "misaligned list", src: "exclude:\n  - a\n   - b\n", err: "line 3: expected a list item"},
+		{name: "list mixed with keys", src: "exclude:\n  - a\n  b: c\n", err: "line 3: expected a list item"},
+		{name: "nested too deep", src: "instrument:\n  a:\n    b: c\n", err: "line 3: mappings can only be nested one level deep"},
+		{name: "missing colon", src: "outdir\n", err: "line 1: expected key: value"},
+		{name: "unterminated double quote", src: "outdir: \"abc\n", err: ":1: unterminated string"},
+		{name: "escaped final quote", src: "outdir: \"abc\\\"\n", err: ":1: unterminated string"},
+		{name: "text after the quote", src: "outdir: \"a\" b\n", err: ":1: unterminated string"},
+		{name: "go escape", src: `outdir: "a\'b"` + "\n", err: `:1: invalid escape \'`},
+		{name: "short hex escape", src: `outdir: "\x4"` + "\n", err: `:1: invalid escape \x`},
+		{name: "lone single quote", src: "outdir: 'a'b'\n", err: ":1: unescaped '"},
+		{name: "unterminated list", src: "exclude: [a, b\n", err: ":1: unterminated list"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ParseConfig(writeConfig(t, test.src))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want one containing %q", err, test.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(config.Global, test.global) {
+				t.Errorf("got top level %q, want %q", config.Global, test.global)
+			}
+
+			commands := test.commands
+			if commands == nil {
+				commands = make(map[string]map[string][]string)
+			}
+
+			if !reflect.DeepEqual(config.Commands, commands) {
+				t.Errorf("got commands %q, want %q", config.Commands, commands)
+			}
+		})
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	path := writeConfig(t, "outdir: a\nbogus: 1\ninstrument:\n  outdir: b\nnocommand:\n  a: b\n")
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = config.Check()
+	if err == nil {
+		t.Fatal("no error for the unknown keys")
+	}
+
+	want := path + `:2: unknown key "bogus", not a flag of any command` + "\n" + path + `:5: unknown command "nocommand"`
+	if err.Error() != want {
+		t.Errorf("got\n%v\nwant\n%s", err, want)
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	config, err := ParseConfig(writeConfig(t, "outdir: a\njobs: 5\nexclude: [x.go, y.go]\ninstrument:\n  outdir: b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opts Options
+	fs := NewFlagSet(FindCommand("instrument"))
+	AddInstrumentFlags(fs, &opts)
+
+	err = fs.Parse([]string{"-jobs", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = config.Apply(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.OutDir != "b" {
+		t.Errorf("got outdir %q, want the one of the command", opts.OutDir)
+	}
+
+	if opts.Jobs != 3 {
+		t.Errorf("got %d jobs, want the 3 of the command line", opts.Jobs)
+	}
+
+	if got := strings.Join(opts.Filter.Exclude.StringList, " "); got != "x.go y.go" {
+		t.Errorf("got excludes %s, want x.go y.go", got)
+	}
+
+	config, err = ParseConfig(writeConfig(t, "instrument:\n  bogus: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = config.Apply(fs)
+	if err == nil || !strings.Contains(err.Error(), `instrument has no flag named "bogus"`) {
+		t.Errorf("got %v for an unknown flag of the command", err)
+	}
+}
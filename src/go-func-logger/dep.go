@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dependencies are copied below this directory of the main module, the
+// leading underscore keeps ./... patterns from matching the copies
+const DepDir = "_gofunclogger"
+
+// runs the go command in dir, returning its stdout
+func runGo(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	return out, nil
+}
+
+// directory of the main module
+func MainModuleDir() (string, error) {
+	return ModuleDir("")
+}
+
+// directory of the module the go command uses in dir
+func ModuleDir(dir string) (string, error) {
+	out, err := runGo(dir, "env", "GOMOD")
+	if err != nil {
+		return "", err
+	}
+
+	gomod := strings.TrimSpace(string(out))
+	if gomod == "" || gomod == os.DevNull {
+		return "", fmt.Errorf("-dep and the funclog runtime need to run inside a module")
+	}
+
+	return filepath.Dir(gomod), nil
+}
+
+// PathDir is the directory the go command runs in for path: the directory
+// itself, the one of a file or the working directory for package patterns
+func PathDir(path string) string {
+	if IsPackagePattern(path) {
+		return ""
+	}
+
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		return path
+	}
+
+	return filepath.Dir(path)
+}
+
+// copy the tree at src to dst, making everything writable since the module
+// cache is read only
+func CopyTree(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(target, data, 0o644)
+	})
+}
+
+// VendorDependency copies the module providing the package importPath out of
+// the module cache into the main module and points go.mod at the copy with a
+// replace directive, so the copy can be instrumented like any other package.
+// A previous copy is thrown away, the copy always starts out pristine.
+func VendorDependency(importPath string) error {
+	pkgs, err := ListPackages(importPath)
+	if err != nil {
+		return err
+	}
+
+	if len(pkgs) != 1 {
+		return fmt.Errorf("-dep %s: expected a single package, got %d", importPath, len(pkgs))
+	}
+
+	pkg := pkgs[0]
+	switch {
+	case IsStandard(pkg):
+		return fmt.Errorf("-dep %s: is part of the standard library", importPath)
+	case pkg.Module == nil:
+		return fmt.Errorf("-dep %s: not provided by a module", importPath)
+	case pkg.Module.Main:
+		return fmt.Errorf("-dep %s: is part of the main module, instrument it directly", importPath)
+	}
+
+	root, err := MainModuleDir()
+	if err != nil {
+		return err
+	}
+
+	// ask for the download location instead of using pkg.Dir, which points
+	// at our own copy when the module was replaced by an earlier run
+	mod := pkg.Module.Path + "@" + pkg.Module.Version
+	out, err := runGo(root, "mod", "download", "-json", mod)
+	if err != nil {
+		return err
+	}
+
+	var download struct {
+		Dir   string
+		Error string
+	}
+
+	err = json.Unmarshal(out, &download)
+	if err != nil {
+		return err
+	}
+
+	if download.Error != "" {
+		return fmt.Errorf("-dep %s: %s", importPath, download.Error)
+	}
+
+	rel := filepath.Join(DepDir, filepath.FromSlash(pkg.Module.Path))
+	copyDir := filepath.Join(root, rel)
+
+	err = os.RemoveAll(copyDir)
+	if err != nil {
+		return err
+	}
+
+	err = CopyTree(download.Dir, copyDir)
+	if err != nil {
+		return err
+	}
+
+	// modules from before go.mod existed still need one to be replaced with
+	gomod := filepath.Join(copyDir, "go.mod")
+	_, err = os.Stat(gomod)
+	if os.IsNotExist(err) {
+		err = os.WriteFile(gomod, []byte("module "+pkg.Module.Path+"\n"), 0o644)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	replace := fmt.Sprintf("-replace=%s=./%s", pkg.Module.Path, filepath.ToSlash(rel))
+	_, err = runGo(root, "mod", "edit", replace)
+	return err
+}
+
+// the copy is ours, so it is instrumented in place
+func InstrumentDependency(importPath string, opts Options) error {
+	err := VendorDependency(importPath)
+	if err != nil {
+		return err
+	}
+
+	opts.InPlace = true
+	opts.Backup = false
+	opts.OutDir = ""
+	opts.BuildTag = ""
+	opts.Changes = nil
+
+	return InstrumentPath(importPath, opts)
+}
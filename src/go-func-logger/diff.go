@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type DiffOp struct {
+	Kind byte // ' ' for unchanged, '-' for removed and '+' for added lines
+	Line string
+	A    int // index into the old lines, valid for ' ' and '-'
+	B    int // index into the new lines, valid for ' ' and '+'
+}
+
+// DiffLines computes the shortest edit script turning a into b using Myers'
+// O(ND) algorithm, so files that only gained a few lines stay cheap to diff
+func DiffLines(a []string, b []string) []DiffOp {
+	n, m := len(a), len(b)
+	max := n + m
+
+	// v[offset+k] is the furthest x reached on diagonal k, trace keeps the
+	// relevant part of v from before every round for the backtracking pass
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		snapshot := make([]int, 2*d+3)
+		copy(snapshot, v[offset-d-1:offset+d+2])
+		trace = append(trace, snapshot)
+
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+
+			v[offset+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+
+		if done {
+			break
+		}
+	}
+
+	var ops []DiffOp
+
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snapshot := trace[d]
+		at := func(k int) int {
+			return snapshot[k+d+1]
+		}
+
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, DiffOp{Kind: ' ', Line: a[x-1], A: x - 1, B: y - 1})
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, DiffOp{Kind: '+', Line: b[y-1], A: x, B: y - 1})
+			} else {
+				ops = append(ops, DiffOp{Kind: '-', Line: a[x-1], A: x - 1, B: y})
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+
+	return ops
+}
+
+// hunk header ranges are 1 based, an empty range names the line before it
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// UnifiedDiff renders the changes between a and b in the format of diff -u,
+// an empty string means there are no changes
+func UnifiedDiff(oldName string, newName string, a []string, b []string) string {
+	ops := DiffLines(a, b)
+
+	var sb strings.Builder
+
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == ' ' {
+			i++
+			continue
+		}
+
+		// extend the hunk for as long as the next change is close enough for
+		// the context of both to overlap
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+		for j := i; j < len(ops) && j-end <= 2*diffContext; j++ {
+			if ops[j].Kind != ' ' {
+				end = j
+			}
+		}
+
+		stop := end + diffContext + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+		}
+
+		aStart, bStart := ops[start].A, ops[start].B
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.Kind != '+' {
+				aCount++
+			}
+
+			if op.Kind != '-' {
+				bCount++
+			}
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, op := range ops[start:stop] {
+			fmt.Fprintf(&sb, "%c%s\n", op.Kind, op.Line)
+		}
+
+		i = stop
+	}
+
+	return sb.String()
+}
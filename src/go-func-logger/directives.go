@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// the //line directives AddLineDirectives writes, which strip removes again
+// if they follow a line with nothing but the InjectedMarker. Generated code
+// pointing back at its source, like goyacc output, names a file other than a
+// .go one.
+var lineDirectivePattern = regexp.MustCompile(`^//line .+\.go:\d+$`)
+
+// AddLineDirectives puts //line directives naming file into src, the source of
+// root with the logs injected, in front of every line whose code does not
+// count as the line it came from anymore: after injected logs, after the
+// statements gofmt broke over several lines and where it collapsed blank
+// lines. The injected code counts as the lines following the one before it.
+// Every directive follows a line with the InjectedMarker, so strip can tell
+// them from the ones in the original.
+// The values of a return statement passed through a func literal broken over
+// several lines get a /*line*/ directive at the end of the injection in front
+// of them.
+func AddLineDirectives(src []byte, root *ast.File, fset *token.FileSet, file string) ([]byte, error) {
+	outFset := token.NewFileSet()
+
+	out, err := parser.ParseFile(outFset, "", src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	orig := LineNodes(root, nil)
+	copied := LineNodes(out, InjectedNodes(out, outFset))
+	if len(orig) != len(copied) {
+		return nil, fmt.Errorf("the instrumented copy has %d statements and declarations of the original's %d", len(copied), len(orig))
+	}
+
+	lines := strings.Split(string(src), "\n")
+
+	// the directives to insert at offsets of src, in the order of the offsets
+	var offsets []int
+	directives := make(map[int]string)
+
+	outBase, origBase := 0, 0 // a line of src counts as origBase + line - outBase
+	moved := func(pos token.Position, want int) bool {
+		if origBase+pos.Line-outBase == want {
+			return false
+		}
+
+		outBase, origBase = pos.Line, want
+		return true
+	}
+
+	for i, n := range orig {
+		if reflect.TypeOf(n) != reflect.TypeOf(copied[i]) {
+			return nil, fmt.Errorf("the instrumented copy has a %T where the original has a %T", copied[i], n)
+		}
+
+		pos := outFset.PositionFor(copied[i].Pos(), false)
+		want := fset.PositionFor(n.Pos(), false)
+
+		// nothing can go in front of a node that does not start its line,
+		// it may be inside a raw string literal or block comment
+		line := lines[pos.Line-1]
+		if len(line)-len(strings.TrimLeft(line, " \t")) == pos.Column-1 && moved(pos, want.Line) {
+			offset := pos.Offset - (pos.Column - 1)
+			offsets = append(offsets, offset)
+			directives[offset] = fmt.Sprintf("%s%s\n//line %s:%d\n", line[:pos.Column-1], InjectedMarker, file, want.Line)
+		}
+
+		ret, ok := n.(*ast.ReturnStmt)
+		if !ok {
+			continue
+		}
+
+		end, values, ok := WrappedValues(copied[i].(*ast.ReturnStmt), out)
+		if !ok {
+			continue
+		}
+
+		pos = outFset.PositionFor(values, false)
+		want = fset.PositionFor(ret.Results[0].Pos(), false)
+		if moved(pos, want.Line) {
+			// the column of the first value stays what it was, as far as
+			// the injection before it allows
+			col := want.Column - (pos.Offset - outFset.PositionFor(end, false).Offset)
+			if col < 1 {
+				col = 1
+			}
+
+			offset := outFset.PositionFor(end, false).Offset
+			offsets = append(offsets, offset)
+			directives[offset] = fmt.Sprintf("/*line %s:%d:%d*/", file, want.Line, col)
+		}
+	}
+
+	var b strings.Builder
+	prev := 0
+	for _, offset := range offsets {
+		b.Write(src[prev:offset])
+		b.WriteString(directives[offset])
+		prev = offset
+	}
+	b.Write(src[prev:])
+
+	return []byte(b.String()), nil
+}
+
+// UnindentLineDirectives moves the //line directives starting a line of root
+// back to the start of theirs in src, the source of root with the logs
+// injected, which is printed with them indented. Only there do they count.
+func UnindentLineDirectives(src []byte, root *ast.File, fset *token.FileSet) []byte {
+	directives := make(map[string]bool)
+	for _, group := range root.Comments {
+		for _, comment := range group.List {
+			if strings.HasPrefix(comment.Text, "//line ") && fset.PositionFor(comment.Pos(), false).Column == 1 {
+				directives[comment.Text] = true
+			}
+		}
+	}
+
+	if len(directives) == 0 {
+		return src
+	}
+
+	outFset := token.NewFileSet()
+	out, err := parser.ParseFile(outFset, "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return src
+	}
+
+	raw := RawStringLines(out, outFset)
+
+	lines := strings.Split(string(src), "\n")
+	for idx, line := range lines {
+		if trimmed := strings.TrimLeft(line, " \t"); directives[trimmed] && !raw[idx+1] {
+			lines[idx] = trimmed
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// WrappedValues is where the first value of a return statement of the
+// instrumented copy starts if they are passed through an injected func
+// literal, and where the InlineEnd in front of them starts
+func WrappedValues(ret *ast.ReturnStmt, root *ast.File) (token.Pos, token.Pos, bool) {
+	if len(ret.Results) != 1 {
+		return token.NoPos, token.NoPos, false
+	}
+
+	call, ok := ret.Results[0].(*ast.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return token.NoPos, token.NoPos, false
+	}
+
+	if _, ok := call.Fun.(*ast.FuncLit); !ok {
+		return token.NoPos, token.NoPos, false
+	}
+
+	for _, group := range root.Comments {
+		for _, comment := range group.List {
+			if comment.Text == InlineEnd && comment.Pos() > call.Lparen && comment.End() <= call.Args[0].Pos() {
+				return comment.Pos(), call.Args[0].Pos(), true
+			}
+		}
+	}
+
+	return token.NoPos, token.NoPos, false
+}
+
+// LineNodes are the statements, declarations and specs of root in the order
+// they start in, without the ones in skip
+func LineNodes(root *ast.File, skip map[ast.Node]bool) []ast.Node {
+	var res []ast.Node
+
+	ast.Inspect(root, func(n ast.Node) bool {
+		switch n.(type) {
+		case ast.Stmt, ast.Decl, ast.Spec:
+			if !skip[n] {
+				res = append(res, n)
+			}
+		}
+
+		return true
+	})
+
+	return res
+}
+
+// InjectedNodes are the nodes of root InjectLogs put in: the statements,
+// declarations and specs followed by the InjectedMarker on the line they end
+// on with everything inside them, and whatever starts inside an inline
+// injection. The values a return statement passes through an inline func
+// literal are not inside one.
+func InjectedNodes(root *ast.File, fset *token.FileSet) map[ast.Node]bool {
+	markers := make(map[int]token.Pos) // line of every marker
+	var spans [][2]token.Pos           // the inline injections
+
+	var start token.Pos
+	for _, group := range root.Comments {
+		for _, comment := range group.List {
+			switch comment.Text {
+			case InjectedMarker:
+				markers[fset.PositionFor(comment.Pos(), false).Line] = comment.Pos()
+			case InlineStart:
+				start = comment.Pos()
+			case InlineEnd:
+				if start.IsValid() {
+					spans = append(spans, [2]token.Pos{start, comment.End()})
+					start = token.NoPos
+				}
+			}
+		}
+	}
+
+	injected := make(map[ast.Node]bool)
+	ast.Inspect(root, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+
+		for _, span := range spans {
+			if n.Pos() > span[0] && n.Pos() < span[1] {
+				injected[n] = true
+			}
+		}
+
+		switch n.(type) {
+		case *ast.CaseClause, *ast.CommClause:
+			// they end with their last statement, which is never injected
+			return true
+		case ast.Stmt, ast.Decl, ast.Spec:
+			marker, ok := markers[fset.PositionFor(n.End(), false).Line]
+			if ok && marker >= n.End() {
+				ast.Inspect(n, func(inner ast.Node) bool {
+					injected[inner] = true
+					return true
+				})
+
+				return false
+			}
+		}
+
+		return true
+	})
+
+	return injected
+}
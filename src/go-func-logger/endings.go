@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// how the lines of a source file end, so what is written back ends them the
+// same way. Lines are read and written with \n in between.
+type LineStyle struct {
+	CRLF           bool   // lines end with \r\n, going by the first one
+	NoFinalNewline bool   // the last line has no line ending
+	Indent         string // one level of indentation if it is not a tab
+	BOM            bool   // the file starts with a UTF-8 byte order mark
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// TrimBOM drops the byte order mark src may start with, GetLineStyle records
+// it so Apply puts it back
+func TrimBOM(src []byte) []byte {
+	return bytes.TrimPrefix(src, utf8BOM)
+}
+
+func GetLineStyle(src []byte) LineStyle {
+	idx := bytes.IndexByte(src, '\n')
+
+	return LineStyle{
+		CRLF:           idx > 0 && src[idx-1] == '\r',
+		NoFinalNewline: len(src) != 0 && src[len(src)-1] != '\n',
+		Indent:         GetIndent(src),
+		BOM:            bytes.HasPrefix(src, utf8BOM),
+	}
+}
+
+// GetIndent is the spaces a level of indentation is made of if more lines are
+// indented with spaces than with tabs: the fewest any line starts with, not
+// counting the * of block comments. Empty for tabs.
+func GetIndent(src []byte) string {
+	tabs, spaces, unit := 0, 0, 0
+
+	for _, line := range strings.Split(string(src), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		n := len(line) - len(trimmed)
+
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			tabs = tabs + 1
+		case n == 0 || strings.TrimSpace(trimmed) == "" || strings.HasPrefix(trimmed, "*"):
+		default:
+			spaces = spaces + 1
+			if unit == 0 || n < unit {
+				unit = n
+			}
+		}
+	}
+
+	if spaces <= tabs {
+		return ""
+	}
+
+	return strings.Repeat(" ", unit)
+}
+
+// Reindent replaces the tabs gofmt indents src with by indent, leaving the
+// lines inside raw string literals alone. src that doesn't parse is returned
+// as it is.
+func Reindent(src []byte, indent string) []byte {
+	if indent == "" {
+		return src
+	}
+
+	fset := token.NewFileSet()
+	root, err := parser.ParseFile(fset, "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return src
+	}
+
+	raw := RawStringLines(root, fset)
+
+	lines := strings.Split(string(src), "\n")
+	for idx, line := range lines {
+		if raw[idx+1] {
+			continue
+		}
+
+		trimmed := strings.TrimLeft(line, "\t")
+		lines[idx] = strings.Repeat(indent, len(line)-len(trimmed)) + trimmed
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// RawStringLines are the lines of root starting inside a raw string literal
+func RawStringLines(root *ast.File, fset *token.FileSet) map[int]bool {
+	raw := make(map[int]bool)
+
+	ast.Inspect(root, func(n ast.Node) bool {
+		lit, ok := n.(*ast.BasicLit)
+		if ok && lit.Kind == token.STRING && strings.HasPrefix(lit.Value, "`") {
+			for line := fset.PositionFor(lit.Pos(), false).Line + 1; line <= fset.PositionFor(lit.End(), false).Line; line++ {
+				raw[line] = true
+			}
+		}
+
+		return true
+	})
+
+	return raw
+}
+
+// Apply gives src, whose lines end with \n, the line endings of s
+func (s LineStyle) Apply(src []byte) []byte {
+	if s.NoFinalNewline {
+		src = bytes.TrimSuffix(src, []byte("\n"))
+	}
+
+	if s.CRLF {
+		src = bytes.ReplaceAll(src, []byte("\n"), []byte("\r\n"))
+	}
+
+	if s.BOM {
+		src = append(append([]byte{}, utf8BOM...), src...)
+	}
+
+	return src
+}
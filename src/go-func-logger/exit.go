@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"go/scanner"
+	"os/exec"
+)
+
+const (
+	ExitOK      = 0
+	ExitFailure = 1 // at least one file could not be processed
+	ExitUsage   = 2 // bad flags or arguments
+	ExitParse   = 3 // every failure was a syntax error in the input
+)
+
+type UsageError struct {
+	Msg string
+}
+
+func (e *UsageError) Error() string {
+	return e.Msg
+}
+
+// flattens errors.Join trees into the individual failures
+func LeafErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+
+	var leaves []error
+	for _, e := range joined.Unwrap() {
+		leaves = append(leaves, LeafErrors(e)...)
+	}
+
+	return leaves
+}
+
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var usageErr *UsageError
+	if errors.As(err, &usageErr) {
+		return ExitUsage
+	}
+
+	// pass on the exit status of a go command we ran
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+
+	for _, leaf := range LeafErrors(err) {
+		var parseErr scanner.ErrorList
+		if !errors.As(leaf, &parseErr) {
+			return ExitFailure
+		}
+	}
+
+	return ExitParse
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"strings"
+	"unicode/utf8"
+)
+
+// GetRecoverLog defers a handler at the entry of a function that logs a panic
+// escaping it together with the stack it was raised on, then panics again so
+// the panic carries on as if nothing had caught it
+func GetRecoverLog(info FuncInfo, opts Options) LogInfo {
+	msg := Message{Event: EventPanic, Text: fmt.Sprintf("Panic escaping %s: %%v\\n%%s", EscapeFormat(LogLabel(info, opts))), Args: []string{"r", "debug.Stack()"}}
+	msg.Fields = GetFuncFields(info, opts)
+	msg.AddField("panic", "%q", "fmt.Sprint(r)")
+	msg.AddField("stack", "%q", "string(debug.Stack())")
+
+	log := FormatLog(msg, opts)
+
+	return LogInfo{
+		Log: fmt.Sprintf("defer func() { if r := recover(); r != nil { %s; panic(r) } }()", log),
+		Col: info.EntryLogPos.Column,
+	}
+}
+
+// calls that end a function without returning from it
+const (
+	ExitPanic    = "panic"
+	ExitOsExit   = "os.Exit"
+	ExitLogFatal = "log.Fatal"
+	ExitLogPanic = "log.Panic"
+	ExitGoexit   = "runtime.Goexit"
+)
+
+type ExitPoint struct {
+	Pos    token.Position
+	Kind   string // empty for returns and the end of the body
+	Naked  bool   // a return statement without values
+	Branch string // condition of the if statement the exit sits directly in, negated in the else branch
+	Source string // source of a return statement with values, shortened to MaxSourceLen
+
+	// start of the values of a return statement, unset if it has none
+	ValuesPos token.Position
+}
+
+// the kind of termination a call is, empty if it is none. testParam is the
+// *testing.T (or B, F, TB) parameter of the function, its Fatal and Skip
+// methods end the test through runtime.Goexit.
+func TerminationKind(expr ast.Expr, testParam string) string {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return ""
+	}
+
+	if testParam != "" {
+		switch {
+		case IsPkgCall(expr, testParam, "Fatal"), IsPkgCall(expr, testParam, "Fatalf"), IsPkgCall(expr, testParam, "FailNow"):
+			return testParam + ".Fatal"
+		case IsPkgCall(expr, testParam, "Skip"), IsPkgCall(expr, testParam, "Skipf"), IsPkgCall(expr, testParam, "SkipNow"):
+			return testParam + ".Skip"
+		}
+	}
+
+	ident, ok := call.Fun.(*ast.Ident)
+	if ok && ident.Name == "panic" {
+		return ExitPanic
+	}
+
+	switch {
+	case IsPkgCall(expr, "os", "Exit"):
+		return ExitOsExit
+	case IsPkgCall(expr, "log", "Fatal"), IsPkgCall(expr, "log", "Fatalf"), IsPkgCall(expr, "log", "Fatalln"):
+		return ExitLogFatal
+	case IsPkgCall(expr, "log", "Panic"), IsPkgCall(expr, "log", "Panicf"), IsPkgCall(expr, "log", "Panicln"):
+		return ExitLogPanic
+	case IsPkgCall(expr, "runtime", "Goexit"):
+		return ExitGoexit
+	}
+
+	return ""
+}
+
+// the source of a node as gofmt prints it, on a single line
+func NodeString(node ast.Node, fset *token.FileSet) string {
+	var buf strings.Builder
+
+	err := printer.Fprint(&buf, fset, node)
+	if err != nil {
+		return ""
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	return strings.Join(lines, " ")
+}
+
+// longest return statement source embedded in an exit log
+const MaxSourceLen = 80
+
+// ShortenSource cuts src down to MaxSourceLen bytes without splitting a rune
+func ShortenSource(src string) string {
+	if len(src) <= MaxSourceLen {
+		return src
+	}
+
+	cut := MaxSourceLen
+	for cut > 0 && !utf8.RuneStart(src[cut]) {
+		cut--
+	}
+
+	return src[:cut] + "..."
+}
+
+// FindBranches maps the offset of every statement sitting directly in the
+// branch of an if statement to the condition guarding it, so exit logs can
+// tell which guard made a function return early
+func FindBranches(body *ast.BlockStmt, fset *token.FileSet) map[int]string {
+	res := make(map[int]string)
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.IfStmt:
+			cond := NodeString(n.Cond, fset)
+			for _, stmt := range n.Body.List {
+				res[fset.PositionFor(stmt.Pos(), false).Offset] = cond
+			}
+
+			block, ok := n.Else.(*ast.BlockStmt)
+			if ok {
+				for _, stmt := range block.List {
+					res[fset.PositionFor(stmt.Pos(), false).Offset] = "!(" + cond + ")"
+				}
+			}
+		}
+
+		return true
+	})
+
+	return res
+}
+
+// FindTerminations finds the statements in body that end the function through
+// panic, os.Exit, log.Fatal, runtime.Goexit or t.Fatal and t.Skip, the ones in
+// func literals end the literal
+func FindTerminations(body *ast.BlockStmt, testParam string, fset *token.FileSet) []ExitPoint {
+	var res []ExitPoint
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ExprStmt:
+			kind := TerminationKind(n.X, testParam)
+			if kind != "" {
+				res = append(res, ExitPoint{Pos: fset.PositionFor(n.Pos(), false), Kind: kind})
+			}
+		}
+
+		return true
+	})
+
+	return res
+}
+
+// a call to pkg.name(...)
+func IsPkgCall(expr ast.Expr, pkg string, name string) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != name {
+		return false
+	}
+
+	ident, ok := sel.X.(*ast.Ident)
+	return ok && ident.Name == pkg
+}
+
+// IsTerminating reports whether control never reaches the statement after
+// stmt, following the terminating statement rules of the spec plus the calls
+// of TerminationKind. Nothing may be injected after such a statement, a
+// function with results would no longer compile.
+func IsTerminating(stmt ast.Stmt, testParam string) bool {
+	return isTerminating(stmt, "", testParam)
+}
+
+func isTerminating(stmt ast.Stmt, label string, testParam string) bool {
+	switch stmt := stmt.(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.BranchStmt:
+		return stmt.Tok == token.GOTO
+	case *ast.ExprStmt:
+		return TerminationKind(stmt.X, testParam) != ""
+	case *ast.BlockStmt:
+		return isTerminatingList(stmt.List, testParam)
+	case *ast.LabeledStmt:
+		return isTerminating(stmt.Stmt, stmt.Label.Name, testParam)
+	case *ast.IfStmt:
+		return stmt.Else != nil && isTerminating(stmt.Body, "", testParam) && isTerminating(stmt.Else, "", testParam)
+	case *ast.ForStmt:
+		return stmt.Cond == nil && !HasBreak(stmt.Body, label)
+	case *ast.SwitchStmt:
+		return isTerminatingClauses(stmt.Body, label, true, testParam)
+	case *ast.TypeSwitchStmt:
+		return isTerminatingClauses(stmt.Body, label, true, testParam)
+	case *ast.SelectStmt:
+		return isTerminatingClauses(stmt.Body, label, false, testParam)
+	}
+
+	return false
+}
+
+func isTerminatingList(list []ast.Stmt, testParam string) bool {
+	return len(list) != 0 && isTerminating(list[len(list)-1], "", testParam)
+}
+
+// every clause has to terminate (or fall through) without breaking out, and
+// a switch needs a default clause
+func isTerminatingClauses(body *ast.BlockStmt, label string, needDefault bool, testParam string) bool {
+	hasDefault := false
+
+	for _, clause := range body.List {
+		var list []ast.Stmt
+
+		switch clause := clause.(type) {
+		case *ast.CaseClause:
+			list = clause.Body
+			hasDefault = hasDefault || clause.List == nil
+		case *ast.CommClause:
+			list = clause.Body
+		}
+
+		if HasBreak(&ast.BlockStmt{List: list}, label) {
+			return false
+		}
+
+		if len(list) != 0 {
+			branch, ok := list[len(list)-1].(*ast.BranchStmt)
+			if ok && branch.Tok == token.FALLTHROUGH {
+				continue
+			}
+		}
+
+		if !isTerminatingList(list, testParam) {
+			return false
+		}
+	}
+
+	return hasDefault || !needDefault
+}
+
+// a break in body leaving the statement body belongs to, either unlabeled or
+// naming label. Unlabeled breaks in nested loops, switches and selects leave
+// those instead.
+func HasBreak(body *ast.BlockStmt, label string) bool {
+	found := false
+
+	var inspect func(n ast.Node, nested bool) bool
+	inspect = func(n ast.Node, nested bool) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			if !nested {
+				ast.Inspect(n, func(inner ast.Node) bool {
+					if inner == n {
+						return true
+					}
+
+					return inspect(inner, true)
+				})
+
+				return false
+			}
+		case *ast.BranchStmt:
+			if n.Tok != token.BREAK {
+				return true
+			}
+
+			if n.Label == nil && !nested || n.Label != nil && n.Label.Name == label {
+				found = true
+			}
+		}
+
+		return !found
+	}
+
+	for _, stmt := range body.List {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			return inspect(n, false)
+		})
+	}
+
+	return found
+}
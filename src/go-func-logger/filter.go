@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// https://go.dev/s/generatedcode
+var generatedRegexp = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// repeatable string flag, e.g. -exclude a -exclude b
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// glob flag that rejects malformed patterns while parsing the command line
+type GlobList struct {
+	StringList
+}
+
+func (l *GlobList) Set(value string) error {
+	_, err := path.Match(value, "")
+	if err != nil {
+		return err
+	}
+
+	return l.StringList.Set(value)
+}
+
+// FileFilter decides which of the files found while resolving the paths are
+// instrumented. Patterns use path.Match syntax and are tried against both the
+// slash separated path relative to the walk root and the bare file name.
+type FileFilter struct {
+	Include   GlobList
+	Exclude   GlobList
+	Generated bool // also pick files carrying the "Code generated ... DO NOT EDIT." header
+	Vendor    bool // walk into vendor directories
+	Testdata  bool // walk into testdata directories
+	Hidden    bool // walk into directories starting with a dot
+	Tests     bool // also pick _test.go files
+}
+
+// the header has to appear before the package clause, so only that part of the
+// file is read
+func IsGeneratedFile(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+
+	defer file.Close()
+
+	// no limit on the length of a line, unlike a bufio.Scanner
+	rd := bufio.NewReader(file)
+	for {
+		line, err := rd.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if generatedRegexp.MatchString(line) {
+			return true
+		}
+
+		if strings.HasPrefix(line, "package ") || err != nil {
+			return false
+		}
+	}
+}
+
+func MatchGlob(pattern string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+
+	ok, _ := path.Match(pattern, rel)
+	if ok {
+		return true
+	}
+
+	ok, _ = path.Match(pattern, path.Base(rel))
+	return ok
+}
+
+func MatchAnyGlob(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if MatchGlob(pattern, rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f FileFilter) MatchFile(filePath string, rel string) bool {
+	if len(f.Include.StringList) != 0 && !MatchAnyGlob(f.Include.StringList, rel) {
+		return false
+	}
+
+	if MatchAnyGlob(f.Exclude.StringList, rel) {
+		return false
+	}
+
+	if !f.Tests && strings.HasSuffix(filePath, "_test.go") {
+		return false
+	}
+
+	return f.Generated || !IsGeneratedFile(filePath)
+}
+
+// an excluded directory is not walked at all, includes only apply to files.
+// Like the go tool, directories starting with an underscore are never walked,
+// DepDir with the copies of the runtime and the -dep modules among them.
+func (f FileFilter) MatchDir(rel string) bool {
+	name := filepath.Base(rel)
+
+	switch {
+	case strings.HasPrefix(name, "_"):
+		return false
+	case name == "vendor" && !f.Vendor:
+		return false
+	case name == "testdata" && !f.Testdata:
+		return false
+	case strings.HasPrefix(name, ".") && name != "." && name != ".." && !f.Hidden:
+		return false
+	}
+
+	return !MatchAnyGlob(f.Exclude.StringList, rel)
+}
+
+// checks every directory leading up to the file at rel
+func (f FileFilter) MatchParents(rel string) bool {
+	dir := filepath.Dir(rel)
+	for dir != "." && dir != string(filepath.Separator) && dir != filepath.VolumeName(dir) {
+		if !f.MatchDir(dir) {
+			return false
+		}
+
+		dir = filepath.Dir(dir)
+	}
+
+	return true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsGeneratedFile(t *testing.T) {
+	long := "// " + strings.Repeat("x", 100*1024) + "\n"
+	header := "// Code generated by stringer. DO NOT EDIT."
+
+	tests := []struct {
+		name string
+		src  string
+		want bool
+	}{
+		{name: "header", src: header + "\n\npackage p\n", want: true},
+		{name: "after a line longer than 64 KiB", src: long + header + "\n\npackage p\n", want: true},
+		{name: "header without trailing newline", src: long + header, want: true},
+		{name: "after the package clause", src: "package p\n\n" + header + "\n", want: false},
+		{name: "without header", src: long + "package p", want: false},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i))+".go")
+
+			err := os.WriteFile(path, []byte(test.src), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := IsGeneratedFile(path); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
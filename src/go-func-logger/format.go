@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// -format, how the logs are written
+const (
+	FormatText   = "text"   // a sentence: Starting func Foo with values: x: 1
+	FormatKV     = "kv"     // key=value fields: event=enter func=Foo param.x=1
+	FormatJSON   = "json"   // a JSON object per log, built by the runtime
+	FormatLogfmt = "logfmt" // logfmt, key=value with the values quoted by the runtime where needed
+)
+
+// the objects -format json groups the fields with a dotted key in
+var jsonGroups = map[string]string{
+	"param":  "params",
+	"result": "results",
+	"type":   "types",
+}
+
+// what a log reports, the event field of the structured formats
+const (
+	EventEnter       = "enter"
+	EventExit        = "exit"
+	EventPanic       = "panic"
+	EventStart       = "start"        // the program started
+	EventFinish      = "finish"       // main returned
+	EventProgramExit = "program_exit" // os.Exit or log.Fatal is about to end the program
+	EventProcess     = "process"      // the process the logs come from, with -process-info once
+)
+
+// -color, what the color of a log depends on
+const (
+	ColorEvent     = "event"     // green entries, blue exits, red panics
+	ColorGoroutine = "goroutine" // a hue per goroutine, red panics
+)
+
+// -process-info, how often the process the logs come from is described
+const (
+	ProcessInfoOnce  = "once"  // in a log of its own before the first log
+	ProcessInfoEvery = "every" // in front of every log
+)
+
+// Message is a log before it is turned into a statement: a sentence for the
+// text format and the same information as fields for the structured ones
+type Message struct {
+	Event  string
+	Text   string   // format string of the sentence
+	Args   []string // expressions for the verbs in Text
+	Fields []Field
+
+	Gated bool   // part of a call whose logs are only written if CallLogVar says so
+	Func  string // RuntimeKey of the function of entry and exit logs, for -rate-limit
+}
+
+// Field is a key with either the Go expression of its value and the verb it
+// is printed with, or a value known while instrumenting
+type Field struct {
+	Key   string
+	Verb  string
+	Expr  string
+	Value string // used if Verb is empty
+	Type  string // Go type of the value if known, for backends with typed fields
+}
+
+// Add appends text and the arguments for its verbs to the sentence
+func (m *Message) Add(text string, args ...string) {
+	m.Text += text
+	m.Args = append(m.Args, args...)
+}
+
+func (m *Message) AddField(key string, verb string, expr string) {
+	m.Fields = append(m.Fields, Field{Key: key, Verb: verb, Expr: expr})
+}
+
+func (m *Message) AddValue(key string, value string) {
+	m.Fields = append(m.Fields, Field{Key: key, Value: value})
+}
+
+func (m *Message) AddInt(key string, value int) {
+	m.Fields = append(m.Fields, Field{Key: key, Value: strconv.Itoa(value), Type: "int"})
+}
+
+// the fields naming the function a log is about, func and for func literals
+// their kind
+func GetFuncFields(info FuncInfo, opts Options) []Field {
+	fields := []Field{{Key: "func", Value: QualifiedName(info, opts)}}
+	if info.Kind != KindFunc {
+		fields = append(fields, Field{Key: "kind", Value: info.Kind})
+	}
+
+	return fields
+}
+
+// GetValueFields is one field per value, keyed prefix plus its label or its
+// position if it has none. Strings are quoted so values with spaces can be
+// told apart from the next field.
+func GetValueFields(prefix string, labels []string, exprs []string, types []string, opts Options) []Field {
+	var fields []Field
+
+	for i, expr := range exprs {
+		label, typ := "", ""
+		if i < len(labels) {
+			label = labels[i]
+		}
+
+		if i < len(types) {
+			typ = types[i]
+		}
+
+		key := prefix + label
+		if label == "" || label == "_" {
+			key = prefix + strconv.Itoa(i)
+		}
+
+		// redacted, skipped and truncated values are strings
+		verb, value := FormatValue(label, typ, expr, opts)
+		if verb == "%s" {
+			typ = "string"
+		}
+
+		if typ == "string" {
+			verb = "%q"
+		}
+
+		fields = append(fields, Field{Key: key, Verb: verb, Expr: value, Type: typ})
+	}
+
+	return fields
+}
+
+// GetLogPrefix returns what goes in front of every log message and the
+// arguments for its verbs
+func GetLogPrefix(opts Options) (string, []string) {
+	var prefix string
+	var args []string
+
+	if opts.ProcessInfo == ProcessInfoEvery {
+		prefix += "[%s] "
+		args = append(args, RuntimeName+".Process()")
+	}
+
+	if opts.Timestamps {
+		prefix += "%s "
+		args = append(args, RuntimeName+".Now()")
+	}
+
+	if opts.GoroutineID {
+		prefix += "[g%d] "
+		args = append(args, RuntimeName+".GoID()")
+	}
+
+	if opts.Indent {
+		prefix += "%s"
+		args = append(args, RuntimeName+".Indent()")
+	}
+
+	return prefix, args
+}
+
+// the fields every log starts with, GetLogPrefix for the structured formats.
+// The indentation of -indent would only get in the way of parsing them.
+func GetPrefixFields(event string, opts Options) []Field {
+	var fields []Field
+
+	if opts.ProcessInfo == ProcessInfoEvery {
+		fields = append(fields, GetProcessFields()...)
+	}
+
+	if opts.Timestamps {
+		fields = append(fields, Field{Key: "time", Verb: "%s", Expr: RuntimeName + ".Now()"})
+	}
+
+	if opts.GoroutineID {
+		fields = append(fields, Field{Key: "goroutine", Verb: "%d", Expr: RuntimeName + ".GoID()"})
+	}
+
+	return append(fields, Field{Key: "event", Value: event})
+}
+
+// the fields describing the process for -process-info
+func GetProcessFields() []Field {
+	return []Field{
+		{Key: "pid", Verb: "%d", Expr: RuntimeName + ".PID()"},
+		{Key: "host", Verb: "%q", Expr: RuntimeName + ".Host()"},
+		{Key: "version", Verb: "%q", Expr: RuntimeName + ".Version()"},
+		{Key: "revision", Verb: "%q", Expr: RuntimeName + ".Revision()"},
+	}
+}
+
+// GetProcessLog describes the process in a log of its own, written by the
+// first instrumented function called only
+func GetProcessLog(info FuncInfo, opts Options) LogInfo {
+	msg := Message{Event: EventProcess, Text: "Process %s", Args: []string{RuntimeName + ".Process()"}, Fields: GetProcessFields()}
+
+	return LogInfo{
+		Log: fmt.Sprintf("if %s.ReportProcess() { %s }", RuntimeName, FormatLog(msg, opts)),
+		Col: info.EntryLogPos.Column,
+	}
+}
+
+// the key=value line of a message and the arguments for its verbs
+func GetKVLine(msg Message, opts Options) (string, []string) {
+	var pairs []string
+	var args []string
+
+	for _, field := range append(GetPrefixFields(msg.Event, opts), msg.Fields...) {
+		if field.Verb == "" {
+			pairs = append(pairs, field.Key+"="+EscapeFormat(QuoteKV(field.Value)))
+			continue
+		}
+
+		pairs = append(pairs, field.Key+"="+field.Verb)
+		args = append(args, field.Expr)
+	}
+
+	return strings.Join(pairs, " "), args
+}
+
+// the funclog.JSON call building the object of a message, with the time of
+// the log as ts
+func GetJSONLine(msg Message, opts Options) (string, []string) {
+	args := []string{strconv.Quote("ts"), RuntimeName + ".Now()"}
+
+	for _, field := range GetPrefixFields(msg.Event, opts) {
+		if field.Key != "time" {
+			args = append(args, strconv.Quote(field.Key), FieldValue(field))
+		}
+	}
+
+	for _, field := range msg.Fields {
+		key := field.Key
+		if group, name, ok := strings.Cut(key, "."); ok && jsonGroups[group] != "" {
+			key = jsonGroups[group] + "." + name
+		}
+
+		args = append(args, strconv.Quote(key), FieldValue(field))
+	}
+
+	return "%s", []string{fmt.Sprintf("%s.JSON(%s)", RuntimeName, strings.Join(args, ", "))}
+}
+
+// the logfmt line of a message, the runtime quotes the values that need it
+func GetLogfmtLine(msg Message, opts Options) (string, []string) {
+	var args []string
+
+	for _, field := range append(GetPrefixFields(msg.Event, opts), msg.Fields...) {
+		args = append(args, strconv.Quote(field.Key), FieldValue(field))
+	}
+
+	return "%s", []string{fmt.Sprintf("%s.Logfmt(%s)", RuntimeName, strings.Join(args, ", "))}
+}
+
+// values known while instrumenting are only quoted if they need to be
+func QuoteKV(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\t\n") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+// FormatLog is the statement writing a log message
+func FormatLog(msg Message, opts Options) string {
+	return RenameImports(GateLog(msg, PrintMessage(msg, opts), opts), opts.ImportNames)
+}
+
+// PrintMessage is the print statement for a log message
+func PrintMessage(msg Message, opts Options) string {
+	switch opts.Backend {
+	case BackendSlog:
+		return SlogLog(msg, opts)
+	case BackendZap:
+		return ZapLog(msg, opts)
+	case BackendZerolog:
+		return ZerologLog(msg, opts)
+	case BackendLogrus:
+		return LogrusLog(msg, opts)
+	}
+
+	var text string
+	var args []string
+
+	switch opts.Format {
+	case FormatKV:
+		text, args = GetKVLine(msg, opts)
+	case FormatJSON:
+		text, args = GetJSONLine(msg, opts)
+	case FormatLogfmt:
+		text, args = GetLogfmtLine(msg, opts)
+	default:
+		prefix, prefixArgs := GetLogPrefix(opts)
+		text = prefix + msg.Text
+		args = append(prefixArgs, msg.Args...)
+	}
+
+	if opts.Ring > 0 && (msg.Event == EventEnter || msg.Event == EventExit) {
+		return RingLog(text, args, opts)
+	}
+
+	return PrintLog(msg.Event, text, args, opts)
+}
@@ -0,0 +1,1059 @@
+// Package funclog is the runtime behind the logs gofunclogger injects, for
+// what a single fmt.Printf can't do. gofunclogger embeds its files and copies
+// them into the module being instrumented, so it may only use the standard
+// library.
+package funclog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// TimeFormat is the layout of the timestamps Now returns, RFC 3339 with
+// microseconds so logs of fast calls can be told apart
+const TimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Now is the current time in TimeFormat
+func Now() string {
+	return time.Now().Format(TimeFormat)
+}
+
+var calls atomic.Uint64
+
+// NextCall numbers the calls of all instrumented functions, starting at 1
+func NextCall() uint64 {
+	return calls.Add(1)
+}
+
+// IndentWidth is what Indent repeats per level of nesting
+const IndentWidth = "  "
+
+var (
+	depthsMu sync.Mutex
+	depths   = map[uint64]int{}
+)
+
+// Enter counts an instrumented function entered on the calling goroutine,
+// Leave undoes it
+func Enter() {
+	id := GoID()
+
+	depthsMu.Lock()
+	depths[id]++
+	depthsMu.Unlock()
+}
+
+func Leave() {
+	id := GoID()
+
+	depthsMu.Lock()
+	depths[id]--
+	if depths[id] <= 0 {
+		delete(depths, id)
+	}
+	depthsMu.Unlock()
+}
+
+// Indent is IndentWidth for every instrumented function the calling
+// goroutine is in, except the one logging
+func Indent() string {
+	id := GoID()
+
+	depthsMu.Lock()
+	depth := depths[id]
+	depthsMu.Unlock()
+
+	if depth <= 1 {
+		return ""
+	}
+
+	return strings.Repeat(IndentWidth, depth-1)
+}
+
+// Truncate formats v like %+v, cut to max characters followed by ... if it is
+// longer
+func Truncate(v any, max int) string {
+	s := fmt.Sprintf("%+v", v)
+	if len(s) <= max {
+		return s
+	}
+
+	// cut at a character, not in the middle of one
+	count := 0
+	for i := range s {
+		if count == max {
+			return s[:i] + "..."
+		}
+
+		count++
+	}
+
+	return s
+}
+
+// Deref is what the pointer v points to, <nil> for a nil pointer and v itself
+// if it is not a pointer
+func Deref(v any) any {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer {
+		return v
+	}
+
+	if rv.IsNil() {
+		return "<nil>"
+	}
+
+	return rv.Elem().Interface()
+}
+
+// PID is the id of the process
+func PID() int {
+	return os.Getpid()
+}
+
+var (
+	hostOnce sync.Once
+	host     string
+)
+
+// Host is the name of the machine, looked up once, unknown if it can't be
+func Host() string {
+	hostOnce.Do(func() {
+		name, err := os.Hostname()
+		if err != nil {
+			name = "unknown"
+		}
+
+		host = name
+	})
+
+	return host
+}
+
+var (
+	buildOnce sync.Once
+	version   string
+	revision  string
+)
+
+func readBuildInfo() {
+	version, revision = "unknown", "unknown"
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+
+	version = info.Main.Version
+
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+
+	if modified {
+		revision += "-dirty"
+	}
+}
+
+// Version is the version of the main module, (devel) when built from a
+// checkout
+func Version() string {
+	buildOnce.Do(readBuildInfo)
+	return version
+}
+
+// Revision is the VCS revision the binary was built from, -dirty if there
+// were uncommitted changes
+func Revision() string {
+	buildOnce.Do(readBuildInfo)
+	return revision
+}
+
+// Process describes the process the logs come from, for telling apart the
+// traces of several instances: pid=4242 host=web-1 version=v1.2.0 revision=0c1a9e2
+func Process() string {
+	return fmt.Sprintf("pid=%d host=%s version=%s revision=%s", PID(), Host(), Version(), Revision())
+}
+
+var processReported atomic.Bool
+
+// ReportProcess is true the first time it is called only, so the process is
+// described once however many goroutines log
+func ReportProcess() bool {
+	return processReported.CompareAndSwap(false, true)
+}
+
+// FuncStats is what the runtime knows about an instrumented function
+type FuncStats struct {
+	Name     string // package qualified, e.g. store.(*DB).Get
+	Calls    atomic.Uint64
+	Sampled  atomic.Uint64 // calls Sample was asked about
+	Disabled atomic.Bool   // its logs are turned off, see FuncOn
+	Every    atomic.Int64  // overrides the rate Sample is called with if positive
+
+	Suppressed atomic.Uint64 // logs Allow dropped
+	unreported atomic.Uint64 // logs Allow dropped since the last report
+
+	bucketMu sync.Mutex
+	tokens   float64
+	refilled time.Time
+}
+
+var funcs sync.Map
+
+// Stats of the function called name, created on first use
+func Stats(name string) *FuncStats {
+	stats, ok := funcs.Load(name)
+	if !ok {
+		created := &FuncStats{Name: name}
+		created.Disabled.Store(!enabledByPatterns(name))
+		stats, _ = funcs.LoadOrStore(name, created)
+	}
+
+	return stats.(*FuncStats)
+}
+
+// Funcs is what the runtime knows about every instrumented function that has
+// been called or toggled so far, sorted by name
+func Funcs() []*FuncStats {
+	var all []*FuncStats
+	funcs.Range(func(_, stats any) bool {
+		all = append(all, stats.(*FuncStats))
+		return true
+	})
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+var (
+	funcPatternsMu   sync.RWMutex
+	funcPatternsOnce sync.Once
+	funcPatterns     []string
+)
+
+func splitPatterns(list string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
+
+func loadFuncPatterns() {
+	funcPatternsOnce.Do(func() {
+		funcPatterns = splitPatterns(os.Getenv("FUNCLOG_FUNCS"))
+	})
+}
+
+// SetFuncs replaces the globs of the FUNCLOG_FUNCS environment variable with
+// list, in the same syntax, and turns every function on or off accordingly
+func SetFuncs(list string) {
+	loadFuncPatterns()
+
+	funcPatternsMu.Lock()
+	funcPatterns = splitPatterns(list)
+	funcPatternsMu.Unlock()
+
+	for _, stats := range Funcs() {
+		stats.Disabled.Store(!enabledByPatterns(stats.Name))
+	}
+}
+
+// enabledByPatterns applies the FUNCLOG_FUNCS environment variable, a comma
+// separated list of globs, to the function called name: those starting with
+// - turn the functions they match off, the others on. A function is on
+// unless the list has a glob turning functions on, the last glob matching it
+// decides. Globs are tried on the name with and without the package, e.g.
+// FUNCLOG_FUNCS=-*.helper,-store.* or FUNCLOG_FUNCS=Parse,Lex.
+func enabledByPatterns(name string) bool {
+	loadFuncPatterns()
+
+	funcPatternsMu.RLock()
+	defer funcPatternsMu.RUnlock()
+
+	on := true
+	for _, pattern := range funcPatterns {
+		if !strings.HasPrefix(pattern, "-") {
+			on = false
+			break
+		}
+	}
+
+	_, short, _ := strings.Cut(name, ".")
+	for _, pattern := range funcPatterns {
+		glob := strings.TrimPrefix(pattern, "-")
+
+		matched, _ := path.Match(glob, name)
+		if !matched {
+			matched, _ = path.Match(glob, short)
+		}
+
+		if matched {
+			on = !strings.HasPrefix(pattern, "-")
+		}
+	}
+
+	return on
+}
+
+// FuncOn reports whether the logs of the function called name are written
+func FuncOn(name string) bool {
+	return !Stats(name).Disabled.Load()
+}
+
+// Disable turns the logs of the function called name off from its next call
+// on, Enable turns them back on. Names are package qualified like in
+// store.(*DB).Get, func literals are followed by their kind, e.g.
+// main.main goroutine.
+func Disable(name string) {
+	Stats(name).Disabled.Store(true)
+}
+
+func Enable(name string) {
+	Stats(name).Disabled.Store(false)
+}
+
+// CountCall counts a call of the function called name and returns how many
+// calls it has seen, including this one
+func CountCall(name string) uint64 {
+	return Stats(name).Calls.Add(1)
+}
+
+// Sample reports whether the logs of a call of the function called name are
+// written when only 1 in every calls is: the first call and every one after
+// it
+func Sample(name string, every int) bool {
+	stats := Stats(name)
+	if override := stats.Every.Load(); override > 0 {
+		every = int(override)
+	}
+
+	if every <= 1 {
+		return true
+	}
+
+	return (stats.Sampled.Add(1)-1)%uint64(every) == 0
+}
+
+// Allow reports whether the function called name may write another log when
+// it may write perSecond of them per second, a token bucket holding as many.
+// The logs it drops are counted and reported on stderr every second.
+func Allow(name string, perSecond int) bool {
+	stats := Stats(name)
+	now := time.Now()
+
+	stats.bucketMu.Lock()
+	if stats.refilled.IsZero() {
+		stats.tokens = float64(perSecond)
+	} else {
+		stats.tokens += now.Sub(stats.refilled).Seconds() * float64(perSecond)
+		if stats.tokens > float64(perSecond) {
+			stats.tokens = float64(perSecond)
+		}
+	}
+
+	stats.refilled = now
+	allowed := stats.tokens >= 1
+	if allowed {
+		stats.tokens--
+	}
+	stats.bucketMu.Unlock()
+
+	if !allowed {
+		stats.Suppressed.Add(1)
+		stats.unreported.Add(1)
+		reportOnce.Do(func() { go reportSuppressed() })
+	}
+
+	return allowed
+}
+
+var reportOnce sync.Once
+
+// reportSuppressed writes how many logs Allow dropped per function once a
+// second, if it dropped any
+func reportSuppressed() {
+	for range time.Tick(time.Second) {
+		for _, stats := range Funcs() {
+			if n := stats.unreported.Swap(0); n != 0 {
+				fmt.Fprintf(os.Stderr, "funclog: suppressed %d logs of %s\n", n, stats.Name)
+			}
+		}
+	}
+}
+
+// SetSample makes Sample log 1 in every calls of the function called name
+// whatever it is called with, 0 goes back to the rate it is called with
+func SetSample(name string, every int) {
+	Stats(name).Every.Store(int64(every))
+}
+
+// marshal encodes v without escaping HTML, errors as their message and values
+// that can't be encoded formatted like %+v
+func marshal(v any) []byte {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	if enc.Encode(v) != nil {
+		buf.Reset()
+		enc.Encode(fmt.Sprintf("%+v", v))
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// JSON is the object of the key value pairs, in order. A key a.b puts b in
+// the object a. Values that can't be marshaled are formatted like %+v.
+func JSON(pairs ...any) string {
+	var keys []string
+	values := map[string][]byte{}
+
+	groupKeys := map[string][]string{}
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+
+		value := marshal(pairs[i+1])
+
+		group, name, ok := strings.Cut(key, ".")
+		if !ok {
+			keys = append(keys, key)
+			values[key] = value
+			continue
+		}
+
+		if _, seen := groupKeys[group]; !seen {
+			keys = append(keys, group)
+		}
+
+		groupKeys[group] = append(groupKeys[group], name)
+		values[key] = value
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		buf.Write(marshal(key))
+		buf.WriteByte(':')
+
+		names, isGroup := groupKeys[key]
+		if !isGroup {
+			buf.Write(values[key])
+			continue
+		}
+
+		buf.WriteByte('{')
+		for j, member := range names {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+
+			buf.Write(marshal(member))
+			buf.WriteByte(':')
+			buf.Write(values[key+"."+member])
+		}
+		buf.WriteByte('}')
+	}
+
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// Logfmt is the logfmt line of the key value pairs: values are formatted
+// like %+v, errors as their message, and quoted if they are empty or contain
+// spaces, quotes, = or control characters
+func Logfmt(pairs ...any) string {
+	var fields []string
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		v := pairs[i+1]
+		if err, ok := v.(error); ok && err != nil {
+			v = err.Error()
+		}
+
+		value := fmt.Sprintf("%+v", v)
+		if value == "" || strings.IndexFunc(value, needsQuote) >= 0 {
+			value = strconv.Quote(value)
+		}
+
+		fields = append(fields, fmt.Sprintf("%v=%s", pairs[i], value))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func needsQuote(r rune) bool {
+	return r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError
+}
+
+// Backups is how many rotated files Output keeps next to the current one,
+// as name.1 (the newest) to name.5
+const Backups = 5
+
+var (
+	outputOnce sync.Once
+	output     io.Writer
+)
+
+// Output is where the logs go: dest is stdout, stderr or the path of a file
+// to append to, unless the FUNCLOG_OUTPUT environment variable names another.
+// Files are rotated once they would grow past rotateMB megabytes, or
+// FUNCLOG_ROTATE_MB, 0 never rotates. Resolved on the first call, a file that
+// can't be opened falls back to stderr.
+func Output(dest string, rotateMB int) io.Writer {
+	outputOnce.Do(func() {
+		if env := os.Getenv("FUNCLOG_OUTPUT"); env != "" {
+			dest = env
+		}
+
+		if env, err := strconv.Atoi(os.Getenv("FUNCLOG_ROTATE_MB")); err == nil {
+			rotateMB = env
+		}
+
+		switch dest {
+		case "", "stdout":
+			output = os.Stdout
+		case "stderr":
+			output = os.Stderr
+		default:
+			file, err := openRotating(dest, int64(rotateMB)<<20)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "funclog: %v, logging to stderr\n", err)
+				output = os.Stderr
+				return
+			}
+
+			output = file
+		}
+	})
+
+	return output
+}
+
+// ANSI colors of the events Color knows, the others keep the default one
+var eventColors = map[string]string{
+	"enter":        "32", // green
+	"exit":         "34", // blue
+	"panic":        "31", // red
+	"program_exit": "33", // yellow
+}
+
+// the hues Color gives goroutines, red is kept for panics
+var goroutineColors = []string{"32", "33", "34", "35", "36", "92", "93", "94", "95", "96"}
+
+var (
+	colorOnce sync.Once
+	colorEnv  string
+	ttys      sync.Map // *os.File to whether it is a terminal
+)
+
+// isTerminal reports whether w is a terminal, close enough without
+// syscalls: a character device
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	tty, ok := ttys.Load(file)
+	if !ok {
+		info, err := file.Stat()
+		tty = err == nil && info.Mode()&os.ModeCharDevice != 0
+		ttys.Store(file, tty)
+	}
+
+	return tty.(bool)
+}
+
+// Color wraps w so the log of event it is written is colored by the event
+// or, with mode goroutine, by the goroutine writing it. Only terminals get
+// colors, unless FUNCLOG_COLOR is always or never, or NO_COLOR is set.
+func Color(mode string, event string, w io.Writer) io.Writer {
+	colorOnce.Do(func() {
+		colorEnv = strings.ToLower(os.Getenv("FUNCLOG_COLOR"))
+		if colorEnv == "" && os.Getenv("NO_COLOR") != "" {
+			colorEnv = "never"
+		}
+	})
+
+	if colorEnv == "never" || colorEnv != "always" && !isTerminal(w) {
+		return w
+	}
+
+	code := eventColors[event]
+	if mode == "goroutine" && event != "panic" {
+		code = goroutineColors[GoID()%uint64(len(goroutineColors))]
+	}
+
+	if code == "" {
+		return w
+	}
+
+	return colorWriter{w: w, code: code}
+}
+
+// colorWriter colors what is written to w, a log per Write
+type colorWriter struct {
+	w    io.Writer
+	code string
+}
+
+func (c colorWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimSuffix(p, []byte("\n"))
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[" + c.code + "m")
+	buf.Write(line)
+	buf.WriteString("\x1b[0m")
+	buf.Write(p[len(line):])
+
+	_, err := c.w.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+var (
+	asyncOnce sync.Once
+	async     atomic.Pointer[asyncWriter]
+)
+
+// Async returns a writer queueing up to size logs for a goroutine to write
+// to w, so writing a log costs a channel send. When the queue is full the log
+// is dropped and counted if drop is true, otherwise the write waits for room.
+// The first call decides, there is a single queue.
+func Async(w io.Writer, size int, drop bool) io.Writer {
+	asyncOnce.Do(func() {
+		a := &asyncWriter{w: w, drop: drop, queue: make(chan asyncOp, size)}
+		go a.run()
+		async.Store(a)
+	})
+
+	return async.Load()
+}
+
+// asyncOp is a log to write or, if done is set, a Flush waiting for the logs
+// queued before it
+type asyncOp struct {
+	p    []byte
+	done chan struct{}
+}
+
+type asyncWriter struct {
+	w       io.Writer
+	drop    bool
+	queue   chan asyncOp
+	dropped atomic.Uint64
+	closed  atomic.Bool
+}
+
+func (a *asyncWriter) run() {
+	for op := range a.queue {
+		if op.done != nil {
+			close(op.done)
+			continue
+		}
+
+		a.w.Write(op.p)
+	}
+}
+
+// Write queues a copy of p, the caller may reuse it
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	if a.closed.Load() {
+		return a.w.Write(p)
+	}
+
+	op := asyncOp{p: append([]byte(nil), p...)}
+	if !a.drop {
+		a.queue <- op
+		return len(p), nil
+	}
+
+	select {
+	case a.queue <- op:
+	default:
+		a.dropped.Add(1)
+	}
+
+	return len(p), nil
+}
+
+// Flush waits until the logs queued by Async so far are written and reports
+// on stderr how many were dropped since the last Flush
+func Flush() {
+	a := async.Load()
+	if a == nil || a.closed.Load() {
+		return
+	}
+
+	done := make(chan struct{})
+	a.queue <- asyncOp{done: done}
+	<-done
+
+	if n := a.dropped.Swap(0); n != 0 {
+		fmt.Fprintf(os.Stderr, "funclog: dropped %d logs, the queue was full\n", n)
+	}
+}
+
+// Close flushes the queue of Async and writes the logs after it right away
+func Close() {
+	Flush()
+
+	if a := async.Load(); a != nil {
+		a.closed.Store(true)
+	}
+}
+
+// rotatingFile appends to a file, moving it to name.1 once it would grow
+// past max bytes
+type rotatingFile struct {
+	mu   sync.Mutex
+	name string
+	max  int64
+	size int64
+	file *os.File
+}
+
+func openRotating(name string, max int64) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, max: max}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.max > 0 && r.size > 0 && r.size+int64(len(p)) > r.max {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// shifts name.1 ... name.Backups-1 up by one, dropping the oldest, and
+// starts a new file
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+
+	for i := Backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+	}
+
+	os.Rename(r.name, r.name+".1")
+	return r.open()
+}
+
+// on starts out as GOFUNCLOG=1 read at startup, On is a single atomic load
+// and inlined
+var on atomic.Bool
+
+func init() {
+	on.Store(os.Getenv("GOFUNCLOG") == "1")
+}
+
+// On reports whether the program runs with the GOFUNCLOG environment variable
+// set to 1 or SetOn turned logging on, the logs of -kill-switch are skipped
+// otherwise
+func On() bool {
+	return on.Load()
+}
+
+func SetOn(enabled bool) {
+	on.Store(enabled)
+}
+
+// the levels of the logs, for Enabled
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// the values of FUNCLOG_LEVEL, off silences even the errors
+var levelNames = map[string]int{
+	"debug":   LevelDebug,
+	"info":    LevelInfo,
+	"warn":    LevelWarn,
+	"warning": LevelWarn,
+	"error":   LevelError,
+	"off":     LevelError + 1,
+}
+
+var (
+	levelOnce sync.Once
+	minLevel  atomic.Int64
+)
+
+func loadLevel() {
+	levelOnce.Do(func() {
+		min, ok := levelNames[strings.ToLower(os.Getenv("FUNCLOG_LEVEL"))]
+		if !ok {
+			min = LevelInfo
+		}
+
+		minLevel.Store(int64(min))
+	})
+}
+
+// Enabled reports whether logs of level are written: those below the level
+// named by the FUNCLOG_LEVEL environment variable are not. Read on the first
+// call, info if it is unset or unknown, so debug logs stay quiet until it is
+// turned up.
+func Enabled(level int) bool {
+	loadLevel()
+	return int64(level) >= minLevel.Load()
+}
+
+// SetLevel replaces the level of FUNCLOG_LEVEL, named like in it
+func SetLevel(name string) error {
+	min, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown level %q", name)
+	}
+
+	loadLevel()
+	minLevel.Store(int64(min))
+	return nil
+}
+
+// LevelName is the name of the level logs have to reach to be written
+func LevelName() string {
+	loadLevel()
+
+	switch minLevel.Load() {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+
+	return "off"
+}
+
+var signalsOnce sync.Once
+
+// HandleSignals makes SIGUSR1 turn logging on and off, see On, and SIGUSR2
+// write the stats of every function to stderr, for programs that can't be
+// restarted. Only the first call does anything, it also turns logging on if
+// start is true and GOFUNCLOG is not set. Does nothing on systems without
+// these signals.
+func HandleSignals(start bool) {
+	signalsOnce.Do(func() {
+		if start && os.Getenv("GOFUNCLOG") == "" {
+			SetOn(true)
+		}
+
+		notifySignals()
+	})
+}
+
+// WriteStats writes the state of the runtime and what it knows about every
+// function to w, a line each
+func WriteStats(w io.Writer) {
+	fmt.Fprintf(w, "funclog: on=%t level=%s\n", On(), LevelName())
+
+	for _, stats := range Funcs() {
+		fmt.Fprintf(w, "funclog: %s calls=%d sampled=%d suppressed=%d", stats.Name, stats.Calls.Load(), stats.Sampled.Load(), stats.Suppressed.Load())
+		if every := stats.Every.Load(); every > 0 {
+			fmt.Fprintf(w, " sample=%d", every)
+		}
+
+		if stats.Disabled.Load() {
+			fmt.Fprint(w, " disabled")
+		}
+
+		fmt.Fprintln(w)
+	}
+}
+
+var (
+	ringMu   sync.Mutex
+	ring     []string
+	ringNext int // where the next line goes, the oldest once the ring is full
+	ringLen  int
+)
+
+// Record keeps line in a ring buffer of the last size lines instead of
+// writing it, for DumpOnPanic
+func Record(size int, line string) {
+	ringMu.Lock()
+	defer ringMu.Unlock()
+
+	if ring == nil {
+		ring = make([]string, size)
+	}
+
+	ring[ringNext] = line
+	ringNext = (ringNext + 1) % len(ring)
+	if ringLen < len(ring) {
+		ringLen++
+	}
+}
+
+// Dump writes the lines in the ring buffer to w, oldest first, and empties it
+func Dump(w io.Writer) {
+	ringMu.Lock()
+	defer ringMu.Unlock()
+
+	if ringLen == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "funclog: the last %d logs:\n", ringLen)
+	for i := 0; i < ringLen; i++ {
+		fmt.Fprintln(w, ring[(ringNext-ringLen+i+len(ring))%len(ring)])
+	}
+
+	ringLen = 0
+}
+
+// DumpOnPanic dumps the ring buffer to stderr when the function deferring it
+// panics and passes the panic on. The innermost instrumented function a panic
+// passes dumps it, the ones above it find it empty.
+func DumpOnPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	Dump(os.Stderr)
+	panic(r)
+}
+
+// Start is the time a call started at, for Since
+func Start() time.Time {
+	return time.Now()
+}
+
+// Since is how long the call started at start has been running
+func Since(start time.Time) time.Duration {
+	return time.Since(start)
+}
+
+// Caller names the caller of the function calling it, as the function
+// qualified with the last element of its package path and file:line, e.g.
+// server.(*Conn).serve (conn.go:112)
+func Caller() string {
+	// Callers itself, Caller and the instrumented function
+	pcs := make([]uintptr, 1)
+	if runtime.Callers(3, pcs) == 0 {
+		return "unknown"
+	}
+
+	frame, _ := runtime.CallersFrames(pcs).Next()
+	return fmt.Sprintf("%s (%s:%d)", filepath.Base(frame.Function), filepath.Base(frame.File), frame.Line)
+}
+
+// GoID is the id of the calling goroutine, as the first line of its stack
+// trace names it: goroutine 18 [running]. The runtime does not expose it
+// otherwise, 0 if it can't be found.
+func GoID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	end := bytes.IndexByte(b, ' ')
+	if end < 0 {
+		return 0
+	}
+
+	id, err := strconv.ParseUint(string(b[:end]), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return id
+}
+
+// Exported formats v like %+v, but only with the exported fields of structs,
+// following pointers. A nil pointer is <nil>.
+func Exported(v any) string {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return "<nil>"
+		}
+
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return fmt.Sprintf("%+v", v)
+	}
+
+	var fields []string
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fields = append(fields, fmt.Sprintf("%s:%+v", field.Name, rv.Field(i).Interface()))
+	}
+
+	return "{" + strings.Join(fields, " ") + "}"
+}
@@ -0,0 +1,120 @@
+// Package funcloghttp serves the state of the funclog runtime over HTTP. It is
+// a package of its own so only programs that mount the handler link net/http,
+// gofunclogger copies it next to the runtime with -http-handler and points
+// the import of funclog at the copy.
+package funcloghttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/himanshu808/go-func-logger/funclog"
+)
+
+// funcState is a function in the JSON Handler serves
+type funcState struct {
+	Name       string `json:"name"`
+	Calls      uint64 `json:"calls"`
+	Sampled    uint64 `json:"sampled"`
+	Suppressed uint64 `json:"suppressed"`
+	Sample     int64  `json:"sample,omitempty"`
+	Disabled   bool   `json:"disabled"`
+}
+
+// Handler serves the state of the runtime as JSON and changes it on POST.
+// Mount it like expvar, e.g. http.Handle("/debug/funclog", funcloghttp.Handler()).
+// A POST takes the form values
+//
+//	on       true or false, funclog.SetOn for -kill-switch
+//	level    a level like FUNCLOG_LEVEL, funclog.SetLevel for -level
+//	funcs    globs like FUNCLOG_FUNCS, funclog.SetFuncs for -func-toggles
+//	enable   a function name, funclog.Enable (repeatable)
+//	disable  a function name, funclog.Disable (repeatable)
+//	sample   NAME=N, funclog.SetSample (repeatable)
+//
+// and answers with the state after applying them.
+func Handler() http.Handler {
+	return http.HandlerFunc(serveHTTP)
+}
+
+func serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		err := applyForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	state := struct {
+		On    bool        `json:"on"`
+		Level string      `json:"level"`
+		Funcs []funcState `json:"funcs"`
+	}{On: funclog.On(), Level: funclog.LevelName(), Funcs: []funcState{}}
+
+	for _, stats := range funclog.Funcs() {
+		state.Funcs = append(state.Funcs, funcState{
+			Name:       stats.Name,
+			Calls:      stats.Calls.Load(),
+			Sampled:    stats.Sampled.Load(),
+			Suppressed: stats.Suppressed.Load(),
+			Sample:     stats.Every.Load(),
+			Disabled:   stats.Disabled.Load(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(state)
+}
+
+func applyForm(r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+
+	if value := r.PostForm.Get("on"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("on: %v", err)
+		}
+
+		funclog.SetOn(enabled)
+	}
+
+	if value := r.PostForm.Get("level"); value != "" {
+		err := funclog.SetLevel(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if values, ok := r.PostForm["funcs"]; ok {
+		funclog.SetFuncs(strings.Join(values, ","))
+	}
+
+	for _, name := range r.PostForm["enable"] {
+		funclog.Enable(name)
+	}
+
+	for _, name := range r.PostForm["disable"] {
+		funclog.Disable(name)
+	}
+
+	for _, value := range r.PostForm["sample"] {
+		name, every, ok := strings.Cut(value, "=")
+		n, err := strconv.Atoi(every)
+		if !ok || err != nil || n < 0 {
+			return fmt.Errorf("sample %q is not NAME=N", value)
+		}
+
+		funclog.SetSample(name, n)
+	}
+
+	return nil
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package funclog
+
+// no SIGUSR1 and SIGUSR2 to listen for
+func notifySignals() {}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package funclog
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifySignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				SetOn(!On())
+				fmt.Fprintf(os.Stderr, "funclog: on=%t\n", On())
+			case syscall.SIGUSR2:
+				WriteStats(os.Stderr)
+			}
+		}
+	}()
+}
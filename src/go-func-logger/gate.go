@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CallLogVar is whether the logs of the current call are written, decided by
+// the runtime once at entry so a call gets both of its logs or none
+const CallLogVar = "funclogLog"
+
+// IsCallGated reports whether the entry and exit logs of the function depend
+// on CallLogVar: with -func-toggles and for sampled functions
+func IsCallGated(info FuncInfo, opts Options) bool {
+	return opts.FuncToggles || GetSampleRate(info, opts) > 1
+}
+
+// GetCallGateLog declares CallLogVar, asking the runtime whether the function
+// is turned on and whether this call is one -sample picks. With -func-toggles
+// the program may sample functions -sample doesn't, so every call asks.
+func GetCallGateLog(info FuncInfo, opts Options) LogInfo {
+	key := strconv.Quote(RuntimeKey(info))
+
+	var conds []string
+	if opts.FuncToggles {
+		conds = append(conds, fmt.Sprintf("%s.FuncOn(%s)", RuntimeName, key))
+	}
+
+	if every := GetSampleRate(info, opts); every > 1 || opts.FuncToggles {
+		conds = append(conds, fmt.Sprintf("%s.Sample(%s, %d)", RuntimeName, key, every))
+	}
+
+	return LogInfo{Log: CallLogVar + " := " + strings.Join(conds, " && "), Col: info.EntryLogPos.Column}
+}
@@ -1,5 +1,16 @@
 module github.com/himanshu808/go-func-logger
 
-go 1.20
+go 1.22.0
 
-require github.com/sanity-io/litter v1.5.5
+require (
+	github.com/dave/dst v0.27.3
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/sanity-io/litter v1.5.5
+	golang.org/x/tools v0.30.0
+)
+
+require (
+	golang.org/x/mod v0.23.0 // indirect
+	golang.org/x/sync v0.11.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+)
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// flags shared by the commands that instrument into an overlay and hand it
+// to the go command
+func AddGoToolFlags(fs *flag.FlagSet, opts *Options, deps *bool) {
+	fs.BoolVar(deps, "deps", false, "also instrument the packages of the main module the given packages depend on")
+	fs.Var(&opts.Std, "std", "also instrument this standard library `package` (repeatable)")
+	fs.IntVar(&opts.Jobs, "jobs", runtime.NumCPU(), "number of files to instrument concurrently")
+	fs.StringVar(&opts.Since, "since", "", "only instrument functions whose bodies changed relative to this git `ref`, - reads a unified diff from stdin")
+	fs.StringVar(&opts.IfInstrumented, "if-instrumented", IfInstrumentedSkip, "what to do with files that already contain injected logs: skip, refresh or error")
+	AddSelectFlags(fs, opts)
+	AddLogFlags(fs, opts)
+}
+
+// RunGoTool instruments the packages into a temporary overlay, runs
+// `go <verb> -overlay <file> <args...>` with the terminal attached and
+// removes the overlay again afterwards
+func RunGoTool(verb string, pkgs []string, args []string, deps bool, opts Options) error {
+	opts.Quiet = true
+
+	err := LoadInstrumentOptions(&opts, pkgs)
+	if err != nil {
+		return err
+	}
+
+	patterns := pkgs
+	if deps {
+		patterns, err = MainModuleDeps(pkgs...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// always go through go/packages, `.` is a package here and not a directory
+	// to walk, which would pick up the _test.go files and subdirectories
+	var files []string
+	for _, pattern := range patterns {
+		pkgFiles, err := FindPackageFiles(pattern, opts.Filter)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, pkgFiles...)
+	}
+
+	// leave no empty directory of the runtime behind either
+	if opts.RuntimeDir != "" {
+		cleanup, err := MakeRuntimeDir(RuntimeVetDir(opts))
+		defer cleanup()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	overlay, dir, err := BuildOverlay(files, opts)
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	overlayPath := filepath.Join(dir, "overlay.json")
+	err = WriteOverlay(overlayPath, overlay)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("go", append([]string{verb, "-overlay", overlayPath}, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// ^C reaches the go command as well, stay around until it is done so
+	// the overlay gets cleaned up
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+
+	return cmd.Run()
+}
+
+func RunRun(cmd *Command, args []string) error {
+	var opts Options
+	var deps bool
+
+	fs := NewFlagSet(cmd)
+	AddGoToolFlags(fs, &opts, &deps)
+
+	fs.Parse(args)
+
+	err := LoadConfig(fs)
+	if err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+
+	if fs.Lookup("files").Value.String() != "" {
+		return &UsageError{Msg: "run does not accept -files, it runs a single package"}
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return &UsageError{Msg: "no package given"}
+	}
+
+	// everything after the package belongs to the program
+	pkg := fs.Arg(0)
+	return RunGoTool("run", []string{pkg}, append([]string{pkg}, fs.Args()[1:]...), deps, opts)
+}
+
+// ParseGoToolArgs splits the arguments left after our flags into packages and
+// the flags for the go command that follow them, e.g. `./pkg/... -run X -v`.
+// Without packages the current directory is used, like the go command does.
+func ParseGoToolArgs(fs *flag.FlagSet, args []string) ([]string, []string, error) {
+	fs.Parse(args)
+
+	err := LoadConfig(fs)
+	if err != nil {
+		return nil, nil, &UsageError{Msg: err.Error()}
+	}
+
+	var pkgs []string
+	rest := fs.Args()
+	for len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		pkgs = append(pkgs, rest[0])
+		rest = rest[1:]
+	}
+
+	manifest := fs.Lookup("files").Value.String()
+	if manifest != "" {
+		listed, err := ReadManifest(manifest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		pkgs = append(pkgs, listed...)
+	}
+
+	if len(pkgs) == 0 {
+		pkgs = []string{"."}
+	}
+
+	return pkgs, rest, nil
+}
+
+func RunTest(cmd *Command, args []string) error {
+	var opts Options
+	var deps bool
+
+	fs := NewFlagSet(cmd)
+	AddGoToolFlags(fs, &opts, &deps)
+
+	pkgs, goArgs, err := ParseGoToolArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// go test wants its flags before the packages
+	return RunGoTool("test", pkgs, append(goArgs, pkgs...), deps, opts)
+}
+
+func AddBuildFlags(fs *flag.FlagSet, output *string) {
+	fs.StringVar(output, "o", "", "write the resulting binary to this `file` (or directory), like go build -o")
+}
+
+func RunBuild(cmd *Command, args []string) error {
+	var opts Options
+	var deps bool
+	var output string
+
+	fs := NewFlagSet(cmd)
+	AddBuildFlags(fs, &output)
+	AddGoToolFlags(fs, &opts, &deps)
+
+	pkgs, goArgs, err := ParseGoToolArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if output != "" {
+		goArgs = append([]string{"-o", output}, goArgs...)
+	}
+
+	// go build wants its flags before the packages
+	return RunGoTool("build", pkgs, append(goArgs, pkgs...), deps, opts)
+}
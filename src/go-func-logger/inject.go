@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// where a log points, the line and column of the node it goes in front of,
+// after or into
+type logPos struct {
+	Line int
+	Col  int
+}
+
+// injector puts the logs into the syntax tree of a file. The tree is decorated
+// with dst, which keeps the comments and blank lines of the file with the
+// nodes they belong to while statements are inserted around them.
+type injector struct {
+	fset *token.FileSet
+	dec  *decorator.Decorator
+	logs map[logPos][]LogInfo // the logs not placed yet
+}
+
+// InjectLogs returns the syntax tree of root with the logs in it. A log that
+// is not inline is a statement inserted in front of the statement starting
+// where it points, or at the end of the block whose closing brace it points
+// at; the imports are declarations or specs in front of or after the ones
+// they point at. An inline log is part of the node it points at, see LogInfo.
+func InjectLogs(root *ast.File, fset *token.FileSet, logs map[int][]LogInfo) (*dst.File, error) {
+	dec := decorator.NewDecorator(fset)
+
+	file, err := dec.DecorateFile(root)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &injector{fset: fset, dec: dec, logs: make(map[logPos][]LogInfo)}
+	for line, infos := range logs {
+		for _, info := range infos {
+			pos := logPos{Line: line, Col: info.Col}
+			in.logs[pos] = append(in.logs[pos], info)
+		}
+	}
+
+	// in the order they were made, the imports keep the one they were added in
+	for _, infos := range in.logs {
+		sort.SliceStable(infos, func(i, j int) bool { return infos[i].Seq < infos[j].Seq })
+	}
+
+	// the nodes are collected first, so the inserted ones are not visited
+	var nodes []dst.Node
+	dst.Inspect(file, func(n dst.Node) bool {
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+
+		return true
+	})
+
+	for _, n := range nodes {
+		err = in.inject(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(in.logs) != 0 {
+		var left []logPos
+		for pos := range in.logs {
+			left = append(left, pos)
+		}
+
+		sort.Slice(left, func(i, j int) bool {
+			if left[i].Line != left[j].Line {
+				return left[i].Line < left[j].Line
+			}
+
+			return left[i].Col < left[j].Col
+		})
+
+		return nil, fmt.Errorf("no place for the log at line %d, column %d: %s", left[0].Line, left[0].Col, in.logs[left[0]][0].Log)
+	}
+
+	return file, nil
+}
+
+func (in *injector) inject(n dst.Node) error {
+	var err error
+
+	switch n := n.(type) {
+	case *dst.File:
+		n.Decls, err = in.insertDecls(n.Decls)
+	case *dst.GenDecl:
+		if n.Tok == token.IMPORT {
+			n.Specs, err = in.insertSpecs(n.Specs)
+		}
+	case *dst.BlockStmt:
+		block := in.dec.Ast.Nodes[n].(*ast.BlockStmt)
+		n.List, err = in.insertStmts(n.List, block.Lbrace+1, block.Rbrace)
+	case *dst.CaseClause:
+		n.Body, err = in.insertStmts(n.Body)
+	case *dst.CommClause:
+		n.Body, err = in.insertStmts(n.Body)
+	case *dst.FuncType:
+		in.nameParams(n)
+	case *dst.ReturnStmt:
+		err = in.wrapResults(n)
+	}
+
+	return err
+}
+
+func (in *injector) position(pos token.Pos) logPos {
+	p := in.fset.PositionFor(pos, false)
+	return logPos{Line: p.Line, Col: p.Column}
+}
+
+// take removes the logs pointing at positions from the ones left to place
+func (in *injector) take(positions ...token.Pos) []LogInfo {
+	var res []LogInfo
+
+	for _, p := range positions {
+		pos := in.position(p)
+		res = append(res, in.logs[pos]...)
+		delete(in.logs, pos)
+	}
+
+	return res
+}
+
+// insertStmts puts the logs in front of the statements of list they point at
+// and the ones pointing at ends, the braces of a block, after them. A log in
+// front of a labeled statement, or the statement it labels, goes in front of
+// the label.
+func (in *injector) insertStmts(list []dst.Stmt, ends ...token.Pos) ([]dst.Stmt, error) {
+	var res []dst.Stmt
+
+	for _, stmt := range list {
+		var starts []token.Pos
+		for n := in.dec.Ast.Nodes[stmt]; n != nil; {
+			starts = append(starts, n.Pos())
+
+			labeled, ok := n.(*ast.LabeledStmt)
+			if !ok {
+				break
+			}
+
+			n = labeled.Stmt
+		}
+
+		logs, err := ParseLogStmts(in.take(starts...))
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, logs...)
+		res = append(res, stmt)
+	}
+
+	logs, err := ParseLogStmts(in.take(ends...))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(res, logs...), nil
+}
+
+func (in *injector) insertDecls(list []dst.Decl) ([]dst.Decl, error) {
+	var res []dst.Decl
+
+	for _, decl := range list {
+		logs, err := ParseLogDecls(in.take(in.dec.Ast.Nodes[decl].Pos()))
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, logs...)
+		res = append(res, decl)
+	}
+
+	return res, nil
+}
+
+// the specs pointing at the end of a spec go after it. Those starting a group
+// of their own are set apart from it by a blank line, see ImportPos.
+func (in *injector) insertSpecs(list []dst.Spec) ([]dst.Spec, error) {
+	var res []dst.Spec
+
+	for _, spec := range list {
+		n := in.dec.Ast.Nodes[spec]
+
+		logs := in.take(n.Pos())
+		before, err := ParseLogSpecs(logs)
+		if err != nil {
+			return nil, err
+		}
+
+		// the specs in front keep the space before spec, the ones after it
+		// the space after it
+		if len(before) != 0 {
+			decs := spec.Decorations()
+			before[0].Decorations().Before = decs.Before
+			decs.Before = dst.NewLine
+			if logs[0].Group {
+				decs.Before = dst.EmptyLine
+			}
+
+			before[len(before)-1].Decorations().After = decs.Before
+		}
+
+		logs = in.take(n.End())
+		after, err := ParseLogSpecs(logs)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(after) != 0 {
+			decs := spec.Decorations()
+			after[len(after)-1].Decorations().After = decs.After
+			decs.After = dst.NewLine
+			if logs[0].Group {
+				decs.After = dst.EmptyLine
+			}
+
+			after[0].Decorations().Before = decs.After
+		}
+
+		res = append(res, before...)
+		res = append(res, spec)
+		res = append(res, after...)
+	}
+
+	return res, nil
+}
+
+// nameParams gives the unnamed parameters whose type a log points at the name
+// it holds
+func (in *injector) nameParams(fnType *dst.FuncType) {
+	if fnType.Params == nil {
+		return
+	}
+
+	for _, field := range fnType.Params.List {
+		typ := in.dec.Ast.Nodes[field.Type]
+		if len(field.Names) != 0 || typ == nil {
+			continue
+		}
+
+		logs := in.take(typ.Pos())
+		if len(logs) == 0 {
+			continue
+		}
+
+		// a comment in front of the name would be printed in front of the
+		// comma before it
+		name := dst.NewIdent(logs[0].Log)
+		name.Decs.End.Append(InjectedName)
+
+		field.Names = []*dst.Ident{name}
+	}
+}
+
+// wrapResults passes the values of ret through the func literal a log
+// pointing at the first of them holds, see GetReturnWrapper
+func (in *injector) wrapResults(ret *dst.ReturnStmt) error {
+	if len(ret.Results) == 0 {
+		return nil
+	}
+
+	first := in.dec.Ast.Nodes[ret.Results[0]]
+	if first == nil {
+		return nil
+	}
+
+	logs := in.take(first.Pos())
+	if len(logs) == 0 {
+		return nil
+	}
+
+	lit, err := ParseLogExpr(logs[0].Log)
+	if err != nil {
+		return err
+	}
+
+	call := &dst.CallExpr{Fun: lit, Args: ret.Results}
+	call.Decs.Start.Append(InlineStart)
+	call.Decs.Lparen.Append(InlineEnd)
+	ret.Results[len(ret.Results)-1].Decorations().End.Append(InlineStart)
+	call.Decs.End.Append(InlineEnd)
+
+	ret.Results = []dst.Expr{call}
+	return nil
+}
+
+// ParseLogStmts parses the statements of the logs, every one of them on a
+// line of its own ending with the InjectedMarker
+func ParseLogStmts(logs []LogInfo) ([]dst.Stmt, error) {
+	if len(logs) == 0 {
+		return nil, nil
+	}
+
+	var src strings.Builder
+	src.WriteString("package p\n\nfunc _() {\n")
+	for _, info := range logs {
+		src.WriteString(info.Log + "\n")
+	}
+	src.WriteString("}\n")
+
+	file, err := parseLogs(src.String(), logs)
+	if err != nil {
+		return nil, err
+	}
+
+	stmts := file.Decls[0].(*dst.FuncDecl).Body.List
+	for _, stmt := range stmts {
+		markInjected(stmt.Decorations())
+	}
+
+	return stmts, nil
+}
+
+// ParseLogDecls parses the declarations the logs hold, see ParseLogStmts
+func ParseLogDecls(logs []LogInfo) ([]dst.Decl, error) {
+	if len(logs) == 0 {
+		return nil, nil
+	}
+
+	var src strings.Builder
+	src.WriteString("package p\n\n")
+	for _, info := range logs {
+		src.WriteString(info.Log + "\n")
+	}
+
+	file, err := parseLogs(src.String(), logs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, decl := range file.Decls {
+		markInjected(decl.Decorations())
+	}
+
+	return file.Decls, nil
+}
+
+// ParseLogSpecs parses the import specs the logs hold, see ParseLogStmts
+func ParseLogSpecs(logs []LogInfo) ([]dst.Spec, error) {
+	if len(logs) == 0 {
+		return nil, nil
+	}
+
+	var src strings.Builder
+	src.WriteString("package p\n\nimport (\n")
+	for _, info := range logs {
+		src.WriteString(info.Log + "\n")
+	}
+	src.WriteString(")\n")
+
+	file, err := parseLogs(src.String(), logs)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := file.Decls[0].(*dst.GenDecl).Specs
+	for _, spec := range specs {
+		markInjected(spec.Decorations())
+	}
+
+	return specs, nil
+}
+
+// ParseLogExpr parses the expression of an inline log
+func ParseLogExpr(log string) (dst.Expr, error) {
+	file, err := parseLogs("package p\n\nvar _ = "+log+"\n", []LogInfo{{Log: log}})
+	if err != nil {
+		return nil, err
+	}
+
+	return file.Decls[0].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).Values[0], nil
+}
+
+func parseLogs(src string, logs []LogInfo) (*dst.File, error) {
+	file, err := decorator.Parse(src)
+	if err != nil {
+		var text []string
+		for _, info := range logs {
+			text = append(text, info.Log)
+		}
+
+		return nil, fmt.Errorf("the injected logs don't parse: %w\n%s", err, strings.Join(text, "\n"))
+	}
+
+	return file, nil
+}
+
+// an injected node starts on a line of its own and ends with the marker
+func markInjected(decs *dst.NodeDecs) {
+	decs.Before = dst.NewLine
+	decs.After = dst.NewLine
+	decs.End.Replace(InjectedMarker)
+}
+
+// PrintLogs prints the tree InjectLogs returned like gofmt does
+func PrintLogs(file *dst.File) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := decorator.Fprint(&buf, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// the lines of src without the markers, their indentation and blank lines
+func trimmedLines(src string) []string {
+	var res []string
+	for _, line := range blankLines(src) {
+		if line != "" {
+			res = append(res, line)
+		}
+	}
+
+	return res
+}
+
+// the lines of src without the markers and their indentation
+func blankLines(src string) []string {
+	var res []string
+	for _, line := range strings.Split(src, "\n") {
+		res = append(res, strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line), InjectedMarker)))
+	}
+
+	return res
+}
+
+// reports whether want are consecutive lines of got
+func containsLines(got []string, want []string) bool {
+	for i := 0; i+len(want) <= len(got); i++ {
+		match := true
+		for j := range want {
+			if got[i+j] != want[j] {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestInjectLogs(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want [][]string
+	}{
+		{
+			name: "compact bodies",
+			src: `package p
+
+func a() { println() }
+
+func b() {}
+`,
+			want: [][]string{
+				{`func a() {`, `fmt.Println("Starting func a")`, `println()`, `fmt.Println("Exiting func a from line 3")`, `}`},
+				{`func b() {`, `fmt.Println("Starting func b")`, `fmt.Println("Exiting func b from line 5")`, `}`},
+			},
+		},
+		{
+			name: "statements sharing a line",
+			src: `package p
+
+func a(x int) {
+	if x > 0 { println(x); return }; println()
+}
+`,
+			want: [][]string{
+				{`if x > 0 {`, `println(x)`, `fmt.Printf("Exiting func a from line 4 (branch: %s)\n", "x > 0")`, `return`, `}`, `println()`},
+			},
+		},
+		{
+			name: "return sharing a line with a call",
+			src: `package p
+
+func f() int {
+	a(); return b()
+}
+`,
+			want: [][]string{
+				{
+					`a()`,
+					`return /*gofunclogger:auto{*/ func(result0 int) int {`,
+					`fmt.Printf("Exiting func f from line 4 (%s) with results: %+v\n", "return b()", result0)`,
+					`return result0`,
+					`}( /*}*/ b() /*gofunclogger:auto{*/) /*}*/`,
+					`}`,
+				},
+			},
+		},
+		{
+			name: "cases and labels",
+			src: `package p
+
+func a(x int) {
+	switch x {
+	case 1: panic(x)
+	default:
+	}
+done:
+	return
+}
+`,
+			want: [][]string{
+				{`case 1:`, `fmt.Println("Exiting func a from line 5 (panic)")`, `panic(x)`},
+				{`fmt.Println("Exiting func a from line 9")`, `done:`, `return`},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := instrument(t, test.src)
+
+			_, err := parser.ParseFile(token.NewFileSet(), "", out, 0)
+			if err != nil {
+				t.Fatalf("the instrumented copy doesn't parse: %v\n%s", err, out)
+			}
+
+			got := trimmedLines(out)
+			for _, want := range test.want {
+				if !containsLines(got, want) {
+					t.Errorf("want the lines\n%s\nin\n%s", strings.Join(want, "\n"), out)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectLogsImports(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		args []string
+		want []string
+	}{
+		{
+			name: "without imports",
+			src: `package p
+
+// a does nothing
+func a() {}
+`,
+			want: []string{`package p`, ``, `import "fmt"`, ``, `// a does nothing`, `func a() {`},
+		},
+		{
+			name: "into the block",
+			src: `package p
+
+import (
+	"errors"
+	"os"
+)
+
+func a() error { return errors.New(os.Args[0]) }
+`,
+			want: []string{`import (`, `"errors"`, `"fmt"`, `"os"`, `)`},
+		},
+		{
+			name: "third party after the standard library",
+			src: `package p
+
+import (
+	"errors"
+	"os"
+)
+
+func a() error { return errors.New(os.Args[0]) }
+`,
+			args: []string{"-backend", "zap"},
+			want: []string{`import (`, `"errors"`, `"os"`, ``, `funclogzap "go.uber.org/zap"`, `)`},
+		},
+		{
+			name: "into the third party group",
+			src: `package p
+
+import (
+	"os"
+
+	"example.com/a"
+	"golang.org/x/b"
+)
+
+func f() { a.F(b.G(os.Args)) }
+`,
+			args: []string{"-backend", "zap", "-recover"},
+			want: []string{`import (`, `"fmt"`, `"os"`, `"runtime/debug"`, ``, `"example.com/a"`, `funclogzap "go.uber.org/zap"`, `"golang.org/x/b"`, `)`},
+		},
+		{
+			name: "standard library before third party",
+			src: `package p
+
+import (
+	"example.com/a"
+)
+
+func f() { a.F() }
+`,
+			want: []string{`import (`, `"fmt"`, ``, `"example.com/a"`, `)`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := instrument(t, test.src, test.args...)
+
+			if !containsLines(blankLines(out), test.want) {
+				t.Errorf("want the lines\n%s\nin\n%s", strings.Join(test.want, "\n"), out)
+			}
+		})
+	}
+}
+
+// logs pointing at the same line and column keep the order GenerateLogs made
+// them in, see there
+func TestInjectLogsOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		args []string
+		want []string
+	}{
+		{
+			name: "empty body",
+			src:  "package p; func h() {}",
+			args: []string{"-recover"},
+			want: []string{
+				`package p`,
+				`import (`,
+				`"fmt"`,
+				`"runtime/debug"`,
+				`)`,
+				`func h() {`,
+				`fmt.Println("Starting func h")`,
+				`defer func() {`,
+				`if r := recover(); r != nil {`,
+				`fmt.Printf("Panic escaping func h: %v\n%s\n", r, debug.Stack())`,
+				`panic(r)`,
+				`}`,
+				`}()`,
+				`fmt.Println("Exiting func h from line 1")`,
+				`}`,
+			},
+		},
+		{
+			name: "return first",
+			src: `package p
+
+func g() { go func() { return }() }
+`,
+			args: []string{"-goroutines"},
+			want: []string{
+				`func g() {`,
+				`fmt.Println("Starting func g")`,
+				`go func() {`,
+				`fmt.Println("Starting goroutine in g")`,
+				`fmt.Println("Exiting goroutine in g from line 3")`,
+				`return`,
+				`}()`,
+				`fmt.Println("Exiting func g from line 3")`,
+				`}`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := instrument(t, test.src, test.args...)
+
+			if !containsLines(trimmedLines(out), test.want) {
+				t.Errorf("want the lines\n%s\nin\n%s", strings.Join(test.want, "\n"), out)
+			}
+
+			for i := 0; i < 20; i++ {
+				if again := instrument(t, test.src, test.args...); again != out {
+					t.Fatalf("instrumenting again gave\n%s\ninstead of\n%s", again, out)
+				}
+			}
+		})
+	}
+}
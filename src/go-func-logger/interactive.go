@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type PickerEntry struct {
+	File string
+	Info FuncInfo
+}
+
+// FuncKey identifies a function across files, it is what the picker selection
+// is keyed by. The column tells apart a func literal from the function it is
+// declared on the line of.
+func FuncKey(filePath string, info FuncInfo) string {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		path = filePath
+	}
+
+	return fmt.Sprintf("%s:%d:%d", path, info.DeclPos.Line, info.DeclPos.Column)
+}
+
+// CollectFunctions lists every function instrumenting paths would touch
+func CollectFunctions(paths []string, opts Options) ([]PickerEntry, error) {
+	var entries []PickerEntry
+	var errs []error
+
+	for _, path := range paths {
+		targets, err := ResolveTargets(path, opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, target := range targets {
+			root, fset, err := GenerateAST(target.Path, nil)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			allFuncInfo, err := GetAllFuncInfo(root, fset)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			for _, info := range FilterFuncInfo(allFuncInfo, target.Path, opts) {
+				entries = append(entries, PickerEntry{File: target.Path, Info: info})
+			}
+		}
+	}
+
+	return entries, errors.Join(errs...)
+}
+
+// parses "3", "1-4" and space or comma separated lists of those
+func ParseSelection(input string, max int) ([]int, error) {
+	var res []int
+
+	fields := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+
+	for _, field := range fields {
+		from, to, isRange := strings.Cut(field, "-")
+		if !isRange {
+			to = from
+		}
+
+		start, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("not a number: %s", from)
+		}
+
+		end, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, fmt.Errorf("not a number: %s", to)
+		}
+
+		if start < 1 || end > max || start > end {
+			return nil, fmt.Errorf("out of range: %s", field)
+		}
+
+		for i := start; i <= end; i++ {
+			res = append(res, i-1)
+		}
+	}
+
+	return res, nil
+}
+
+func DrawPicker(w io.Writer, entries []PickerEntry, selected []bool) {
+	fmt.Fprintf(w, "\n%4s  %-3s  %-30s  %-40s  %s\n", "#", "", "function", "location", "params")
+	for idx, entry := range entries {
+		box := "[ ]"
+		if selected[idx] {
+			box = "[x]"
+		}
+
+		location := fmt.Sprintf("%s:%d", entry.File, entry.Info.DeclPos.Line)
+		fmt.Fprintf(w, "%4d  %s  %-30s  %-40s  %d\n", idx+1, box, DisplayName(entry.Info), location, len(entry.Info.Params))
+	}
+
+	fmt.Fprintln(w, "\ntoggle with numbers or ranges (1 3-5), a = all, n = none, empty line = instrument the selection, q = quit")
+	fmt.Fprint(w, "> ")
+}
+
+// RunPicker shows the functions with checkboxes and lets the user toggle them
+// until an empty line confirms the selection. The returned set is keyed by
+// FuncKey, nil means the user quit.
+func RunPicker(in io.Reader, w io.Writer, entries []PickerEntry) (map[string]bool, error) {
+	selected := make([]bool, len(entries))
+
+	rd := bufio.NewReader(in)
+	for {
+		DrawPicker(w, entries, selected)
+
+		line, err := rd.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil, nil
+		}
+
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		input := strings.TrimSpace(line)
+		switch input {
+		case "":
+			res := make(map[string]bool)
+			for idx, entry := range entries {
+				if selected[idx] {
+					res[FuncKey(entry.File, entry.Info)] = true
+				}
+			}
+
+			return res, nil
+		case "q", "quit":
+			return nil, nil
+		case "a", "all":
+			for idx := range selected {
+				selected[idx] = true
+			}
+		case "n", "none":
+			for idx := range selected {
+				selected[idx] = false
+			}
+		default:
+			indexes, err := ParseSelection(input, len(entries))
+			if err != nil {
+				fmt.Fprintln(w, err)
+				continue
+			}
+
+			for _, idx := range indexes {
+				selected[idx] = !selected[idx]
+			}
+		}
+	}
+}
+
+// PickFunctions runs the picker on the terminal, falling back to stdin where
+// there is no controlling terminal
+func PickFunctions(paths []string, opts Options) (map[string]bool, error) {
+	entries, err := CollectFunctions(paths, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return map[string]bool{}, nil
+	}
+
+	in := io.Reader(os.Stdin)
+
+	tty, err := os.Open("/dev/tty")
+	if err == nil {
+		defer tty.Close()
+		in = tty
+	}
+
+	return RunPicker(in, os.Stderr, entries)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFuncKey(t *testing.T) {
+	src := `package p
+
+func f() { go func() {}() }
+`
+
+	root, fset, err := GenerateAST("p.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allFuncInfo, err := GetAllFuncInfo(root, fset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(allFuncInfo) != 2 {
+		t.Fatalf("got %d functions, want f and its goroutine", len(allFuncInfo))
+	}
+
+	outer, inner := FuncKey("p.go", allFuncInfo[0]), FuncKey("p.go", allFuncInfo[1])
+	if outer == inner {
+		t.Errorf("f and its goroutine share the key %s", outer)
+	}
+
+	opts := Options{Goroutines: true, Selected: map[string]bool{inner: true}}
+	got := FilterFuncInfo(allFuncInfo, "p.go", opts)
+	if len(got) != 1 || got[0].Kind != KindGoroutine {
+		t.Errorf("picking the goroutine picked %d functions", len(got))
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []int
+		err   string
+	}{
+		{input: "", want: nil},
+		{input: "3", want: []int{2}},
+		{input: "1 3-5", want: []int{0, 2, 3, 4}},
+		{input: "2,4, 6", want: []int{1, 3, 5}},
+		{input: "5-5", want: []int{4}},
+		{input: "0", err: "out of range: 0"},
+		{input: "7", err: "out of range: 7"},
+		{input: "5-7", err: "out of range: 5-7"},
+		{input: "4-2", err: "out of range: 4-2"},
+		{input: "x", err: "not a number: x"},
+		{input: "1-", err: "not a number: "},
+		{input: "-3", err: "not a number: "},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSelection(test.input, 6)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("ParseSelection(%q): got error %v, want %s", test.input, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseSelection(%q): %v", test.input, err)
+			continue
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("ParseSelection(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+)
+
+// LookupInterface resolves a name like io.Reader or example.com/pkg.Store.
+// imp has to be the importer the packages are checked with, types from two
+// importers never match.
+func LookupInterface(name string, imp types.Importer) (*types.Interface, error) {
+	dot := strings.LastIndex(name, ".")
+	if dot <= 0 || dot == len(name)-1 {
+		return nil, fmt.Errorf("invalid -interface %q, must be package.Name like io.Reader", name)
+	}
+
+	pkg, err := imp.Import(name[:dot])
+	if err != nil {
+		return nil, fmt.Errorf("-interface %s: %w", name, err)
+	}
+
+	obj := pkg.Scope().Lookup(name[dot+1:])
+	if obj == nil {
+		return nil, fmt.Errorf("-interface %s: %s has no %s", name, name[:dot], name[dot+1:])
+	}
+
+	iface, ok := obj.Type().Underlying().(*types.Interface)
+	if !ok {
+		return nil, fmt.Errorf("-interface %s: not an interface", name)
+	}
+
+	return iface, nil
+}
+
+// SelectImplementations type checks the packages of the files under paths and
+// returns the FuncKeys of every method that implements one of the methods of
+// the interface, either on the type or on a pointer to it
+func SelectImplementations(paths []string, opts Options) (map[string]bool, error) {
+	fset := token.NewFileSet()
+	imp := importer.ForCompiler(fset, "source", nil)
+
+	iface, err := LookupInterface(opts.Interface, imp)
+	if err != nil {
+		return nil, err
+	}
+
+	// a package is checked as a whole, the files are what was asked for
+	wanted := make(map[string]bool)
+	var dirs []string
+	for _, path := range paths {
+		files, err := ResolveFiles(path, opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, filePath := range files {
+			absPath, err := filepath.Abs(filePath)
+			if err != nil {
+				return nil, err
+			}
+
+			dir := filepath.Dir(absPath)
+			if !wanted[dir] {
+				dirs = append(dirs, dir)
+			}
+
+			wanted[dir] = true
+			wanted[absPath] = true
+		}
+	}
+
+	selected := make(map[string]bool)
+	for _, dir := range dirs {
+		files, info, err := CheckPackage(dir, fset, imp)
+		if err != nil {
+			return nil, err
+		}
+
+		for filePath, root := range files {
+			if !wanted[filePath] {
+				continue
+			}
+
+			for _, key := range FindImplementations(filePath, root, fset, info, iface) {
+				selected[key] = true
+			}
+		}
+	}
+
+	return selected, nil
+}
+
+// CheckPackage parses and type checks the package in dir, test files included
+// so methods declared in them are found too. Type errors are tolerated, the
+// information needed here is usually still there.
+func CheckPackage(dir string, fset *token.FileSet, imp types.Importer) (map[string]*ast.File, *types.Info, error) {
+	pkg, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string]*ast.File)
+	var parsed []*ast.File
+	for _, name := range append(pkg.GoFiles, pkg.TestGoFiles...) {
+		filePath := filepath.Join(dir, name)
+
+		root, err := parser.ParseFile(fset, filePath, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files[filePath] = root
+		parsed = append(parsed, root)
+	}
+
+	info := &types.Info{Defs: make(map[*ast.Ident]types.Object)}
+	conf := types.Config{Importer: imp, Error: func(error) {}}
+	conf.Check(pkg.ImportPath, fset, parsed, info)
+
+	return files, info, nil
+}
+
+// keys of the methods in root that implement a method of iface
+func FindImplementations(filePath string, root *ast.File, fset *token.FileSet, info *types.Info, iface *types.Interface) []string {
+	var keys []string
+
+	for _, decl := range root.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil {
+			continue
+		}
+
+		method, ok := info.Defs[fn.Name].(*types.Func)
+		if !ok {
+			continue
+		}
+
+		obj, _, _ := types.LookupFieldOrMethod(iface, false, method.Pkg(), method.Name())
+		if obj == nil {
+			continue
+		}
+
+		recv := method.Type().(*types.Signature).Recv().Type()
+		if ptr, ok := recv.(*types.Pointer); ok {
+			recv = ptr.Elem()
+		}
+
+		if !types.Implements(recv, iface) && !types.Implements(types.NewPointer(recv), iface) {
+			continue
+		}
+
+		keys = append(keys, FuncKey(filePath, FuncInfo{DeclPos: fset.PositionFor(fn.Pos(), false)}))
+	}
+
+	return keys
+}
+
+// narrows opts.Selected down to the implementations of -interface
+func LoadSelection(opts *Options, paths []string) error {
+	if opts.Interface == "" {
+		return nil
+	}
+
+	selected, err := SelectImplementations(paths, *opts)
+	if err != nil {
+		return err
+	}
+
+	opts.Selected = selected
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+)
+
+// the main function of package main, where the program starts and ends
+func IsProgramMain(info FuncInfo) bool {
+	return info.Kind == KindFunc && info.Package == "main" && info.Name == "main" && info.Receiver == ""
+}
+
+// GetLifecycleLogs announces the start of the program and defers a handler
+// reporting how it ended: normally, or through a panic that is passed on
+// after logging it. os.Exit skips deferred calls, so exits through it are
+// logged right before the call instead.
+func GetLifecycleLogs(info FuncInfo, opts Options) []LogInfo {
+	col := info.EntryLogPos.Column
+
+	panic := Message{Event: EventPanic, Text: "Program terminated by panic: %v", Args: []string{"r"}}
+	panic.AddField("panic", "%q", "fmt.Sprint(r)")
+
+	panicked := FormatLog(panic, opts) + FlushLogs(opts)
+	finished := FormatLog(Message{Event: EventFinish, Text: "Program finished"}, opts) + FlushLogs(opts)
+
+	return []LogInfo{
+		{Log: FormatLog(Message{Event: EventStart, Text: "Program started"}, opts), Col: col},
+		{Log: fmt.Sprintf("defer func() { if r := recover(); r != nil { %s; panic(r) }; %s }()", panicked, finished), Col: col},
+	}
+}
+
+// os.Exit and log.Fatal end the program without running the deferred handler
+func EndsProgram(point ExitPoint) bool {
+	return point.Kind == ExitOsExit || point.Kind == ExitLogFatal
+}
+
+func GetExitCallLog(point ExitPoint, opts Options) LogInfo {
+	msg := Message{Event: EventProgramExit, Text: fmt.Sprintf("Program exiting through %s from line %d", point.Kind, point.Pos.Line)}
+	msg.AddValue("through", point.Kind)
+	msg.AddInt("line", point.Pos.Line)
+
+	return LogInfo{Log: FormatLog(msg, opts) + FlushLogs(opts), Col: point.Pos.Column}
+}
+
+// FlushLogs waits for the logs queued by -async to be written, appended to the
+// last log before the program ends
+func FlushLogs(opts Options) string {
+	if opts.Async == 0 {
+		return ""
+	}
+
+	return "; " + RuntimeName + ".Flush()"
+}
@@ -2,29 +2,165 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	// "github.com/sanity-io/litter"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
-	"log"
+	"go/types"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
+// kinds of function bodies that get instrumented
+const (
+	KindFunc      = "func"
+	KindGoroutine = "goroutine"     // func literal started by a go statement
+	KindDefer     = "deferred func" // func literal run by a defer statement
+	KindSubtest   = "subtest"       // func literal run by t.Run
+)
+
 type FuncInfo struct {
-	Name        string
+	Kind        string
+	Name        string   // for func literals the name of the enclosing function
+	Package     string   // name of the package the function belongs to
+	Receiver    string   // receiver type of a method, e.g. *Server
+	RecvName    string   // name of the receiver, empty if it has none
+	TypeParams  []string // type parameters of generic functions and of the receiver of their methods
+	TestParam   string   // name of a *testing.T, *testing.B, *testing.F or testing.TB parameter
 	Params      []string
 	Returns     []string
-	EntryLogPos token.Position   // only one entry point of a func
-	ExitLogPos  []token.Position // there can be multiple exit points
+	ResultTypes []string // one per result, named or not
+	ParamTypes  []string // one per parameter, named or not
+
+	// where the type of every parameter starts when none of them is named,
+	// -name-params inserts the placeholder names there
+	UnnamedParams []token.Position
+	DeclPos       token.Position // position of the func keyword
+	BodyPos       token.Position // position of the opening brace of the body
+	EndPos        token.Position // position of the closing brace of the body
+	EntryLogPos   token.Position // only one entry point of a func
+	ExitLogPos    []ExitPoint    // there can be multiple exit points
+	Terminations  []ExitPoint    // panic, os.Exit, log.Fatal, runtime.Goexit, t.Fatal and t.Skip calls
+}
+
+type Options struct {
+	InPlace        bool        // rewrite the original file instead of writing a debug_ copy
+	Backup         bool        // keep a .orig copy of files rewritten in place
+	OutDir         string      // mirror instrumented files into this directory tree
+	NameTemplate   string      // text/template for the name of the instrumented copy, see NameData
+	EntryTemplate  string      // text/template for the start of entry logs, see MessageData
+	ExitTemplate   string      // text/template for the start of exit logs
+	Format         string      // how the logs are written, FormatText or FormatKV
+	Backend        string      // what the logs are written with, one of the Backend constants
+	Logger         string      // expression of the logger the zap, zerolog and logrus backends write to, their global one if empty
+	LogCall        string      // printf style function writing the logs instead of the backend, e.g. mypkg.Logger.Debugf
+	LogImport      string      // import path of the package -log-call starts with
+	Output         string      // where the fmt backend writes to, stdout, stderr or a file, through the runtime if not empty
+	RotateMB       int         // rotate the -output file once it grows past this many megabytes, 0 never
+	Color          string      // color the logs by event or goroutine when they go to a terminal, not at all if empty
+	Async          int         // queue this many logs for a goroutine to write, 0 writes them right away
+	AsyncDrop      bool        // drop logs when the -async queue is full instead of waiting
+	Level          string      // level the logs are logged at and gated on with FUNCLOG_LEVEL, ungated if empty
+	KillSwitch     bool        // only log when the program runs with GOFUNCLOG=1
+	Signals        bool        // SIGUSR1 turns logging on and off, SIGUSR2 writes the stats of the runtime
+	Sample         int         // log 1 in this many calls of every function
+	SampleFuncs    SampleRates // -sample for the functions matching a pattern
+	FuncToggles    bool        // let the program turn the logs of single functions off, see funclog.Disable
+	HTTPHandler    bool        // copy funcloghttp next to the runtime for the program to mount
+	Ring           int         // keep the entry and exit logs of the last this many calls in memory and only write them on panics
+	RateLimit      int         // most log lines a function writes per second
+	ProcessInfo    string      // how often the process the logs come from is described, "" for never
+	BuildTag       string      // guard the copy with this build tag and the original with its negation
+	Deps           StringList  // import paths of dependencies to copy into the module and instrument
+	LogReceiver    bool        // log the receiver of methods alongside the parameters
+	Timestamps     bool        // prefix every log with the time it was written at
+	GoroutineID    bool        // prefix every log with the id of the goroutine writing it
+	Durations      bool        // log how long the function ran at every exit
+	Caller         bool        // log who called the function on entry
+	Qualified      bool        // qualify function names in the logs with their package name
+	CallIDs        bool        // number every call so its entry and exit logs can be paired up
+	CountCalls     bool        // count the calls of every function and log the count on entry
+	Indent         bool        // indent the logs by call depth so nested calls read like a tree
+	MaxValueLen    int         // cut logged values longer than this many characters, 0 for no limit
+	Redact         GlobList    // names of parameters and results whose values are not logged
+	SkipTypes      StringList  // types whose values are not logged, only the type
+	Deref          bool        // log what pointer parameters and results point to instead of the address
+	ExitErrors     bool        // log exits of functions returning an error only if it is non-nil
+	ReceiverFormat string      // how the receiver is logged: value, exported, type or pointer
+	NameParams     bool        // name unnamed parameters arg0, arg1, ... so their values can be logged
+	Recover        bool        // log panics escaping a function with a stack trace and re-panic
+	Goroutines     bool        // also instrument func literals started by go statements
+	Defers         bool        // also instrument func literals run by defer statements
+	Interface      string      // only instrument the methods implementing this interface, e.g. io.Reader
+	KeepMtime      bool        // give written files the modification time of their source
+	LineDirectives bool        // point the positions of the instrumented copy back at the original with //line directives
+	Std            StringList  // standard library packages to instrument, only into an overlay
+	DryRun         bool        // print a diff of the changes instead of writing anything
+	Filter         FileFilter
+	Jobs           int // number of files instrumented concurrently
+
+	// what to do with files that already contain injected logs: skip them,
+	// refresh (strip and instrument again) or fail
+	IfInstrumented string
+
+	Since   string    // only instrument functions changed relative to this git ref, - reads a diff from stdin
+	Changes ChangeSet // the changes Since resolved to
+
+	Quiet      bool   // no progress lines, only problems are reported
+	Overlay    string // write a go build -overlay file mapping the sources to instrumented copies
+	OverlayDir string // temporary directory holding the instrumented copies of an overlay
+
+	Interactive bool            // pick the functions to instrument in a terminal UI
+	Selected    map[string]bool // FuncKey of the picked functions, nil if every function is wanted
+
+	RuntimeDir    string // where the funclog runtime is copied to, empty if the logs do not need it
+	RuntimeImport string // import path of the runtime copy
+
+	ImportNames map[string]string // what the logs of the current file call the StdLogImports by instead of their own name
+	LineStyle   LineStyle         // how the lines of the current file end
+	LineFile    string            // what the //line directives of the current file name, empty without -line-directives
+}
+
+const (
+	IfInstrumentedSkip    = "skip"
+	IfInstrumentedRefresh = "refresh"
+	IfInstrumentedError   = "error"
+)
+
+// Output collects what processing a single file prints, so files handled
+// concurrently can be flushed one after the other in a stable order
+type Output struct {
+	Stdout bytes.Buffer
+	Stderr bytes.Buffer
 }
 
+func (o *Output) Flush() {
+	os.Stdout.Write(o.Stdout.Bytes())
+	os.Stderr.Write(o.Stderr.Bytes())
+}
+
+// LogInfo is a piece of code InjectLogs puts into the syntax tree at the node
+// starting at Col of the line it is filed under
 type LogInfo struct {
 	Log string
 	Col int
+
+	// part of the node at Col instead of a statement of its own: the name of
+	// the unnamed parameter whose type starts there, or the func literal the
+	// values of the return statement starting there are passed through
+	Inline bool
+	Seq    int  // orders the logs at the same column, see GenerateLogs
+	Group  bool // an import spec set apart from the specs it goes next to by a blank line
 }
 
 func NewFuncInfo(fset *token.FileSet) FuncInfo {
@@ -33,10 +169,14 @@ func NewFuncInfo(fset *token.FileSet) FuncInfo {
 
 	fnInfo := FuncInfo{}
 
+	fnInfo.Kind = KindFunc
 	fnInfo.Name = ""
 	fnInfo.Params = nil
 	fnInfo.Returns = nil
-	fnInfo.EntryLogPos = fset.Position(zeroPos)
+	fnInfo.DeclPos = fset.PositionFor(zeroPos, false)
+	fnInfo.BodyPos = fset.PositionFor(zeroPos, false)
+	fnInfo.EndPos = fset.PositionFor(zeroPos, false)
+	fnInfo.EntryLogPos = fset.PositionFor(zeroPos, false)
 	fnInfo.ExitLogPos = nil
 
 	return fnInfo
@@ -56,15 +196,21 @@ func HasField(s interface{}, field string) bool {
 	return r.FieldByName(field).IsValid()
 }
 
-func GenerateAST(fileName string) (*ast.File, *token.FileSet) {
+// src is handed to parser.ParseFile as is, a nil src reads fileName from disk
+func GenerateAST(fileName string, src []byte) (*ast.File, *token.FileSet, error) {
 	fset := token.NewFileSet()
 
-	root, err := parser.ParseFile(fset, fileName, nil, parser.SkipObjectResolution)
+	var source interface{}
+	if src != nil {
+		source = src
+	}
+
+	root, err := parser.ParseFile(fset, fileName, source, parser.ParseComments|parser.SkipObjectResolution)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
-	return root, fset
+	return root, fset, nil
 }
 
 func IsFuncBodyValid(body *ast.BlockStmt) bool {
@@ -83,18 +229,21 @@ func IsFuncBodyValid(body *ast.BlockStmt) bool {
 	return true
 }
 
-func ExtractNameFromField(field *ast.Field) string {
+// a field declaring several names, `a, b int`, gives one name for each of
+// them, an unnamed one a single empty name
+func ExtractNamesFromField(field *ast.Field) []string {
 	//litter.Dump(*field)
 
 	if !HasField(field, "Names") || !HasField(field, "Type") || len(field.Names) == 0 {
-		return ""
+		return []string{""}
 	}
 
-	if len(field.Names) > 1 {
-		log.Fatal("unknown parameter type")
+	var names []string
+	for _, name := range field.Names {
+		names = append(names, name.Name)
 	}
 
-	return field.Names[0].Name
+	return names
 }
 
 func GetParamNames(params *ast.FieldList) []string {
@@ -105,19 +254,28 @@ func GetParamNames(params *ast.FieldList) []string {
 	}
 
 	for _, field := range params.List {
-		res = append(res, ExtractNameFromField(field))
+		res = append(res, ExtractNamesFromField(field)...)
 	}
 
 	return res
 }
 
-func FindReturnStmts(fn *ast.FuncDecl, fset *token.FileSet) []token.Position {
-	var res []token.Position
+// returns inside func literals leave the literal, not the function around it
+func FindReturnStmts(body *ast.BlockStmt, fset *token.FileSet) []ExitPoint {
+	var res []ExitPoint
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			point := ExitPoint{Pos: fset.PositionFor(n.Pos(), false), Naked: len(n.Results) == 0}
+			if !point.Naked {
+				point.ValuesPos = fset.PositionFor(n.Results[0].Pos(), false)
+				point.Source = ShortenSource(NodeString(n, fset))
+			}
 
-	ast.Inspect(fn, func(n ast.Node) bool {
-		ret, ok := n.(*ast.ReturnStmt)
-		if ok {
-			res = append(res, fset.Position(ret.Pos()))
+			res = append(res, point)
 		}
 
 		return true
@@ -126,47 +284,168 @@ func FindReturnStmts(fn *ast.FuncDecl, fset *token.FileSet) []token.Position {
 	return res
 }
 
+// the type parameters a method of a generic type names in its receiver, T and
+// U in func (p *Pair[T, U]) Swap()
+func GetRecvTypeParams(recv ast.Expr) []string {
+	var res []string
+
+	if star, ok := recv.(*ast.StarExpr); ok {
+		recv = star.X
+	}
+
+	var indices []ast.Expr
+	switch recv := recv.(type) {
+	case *ast.IndexExpr:
+		indices = []ast.Expr{recv.Index}
+	case *ast.IndexListExpr:
+		indices = recv.Indices
+	}
+
+	for _, index := range indices {
+		ident, ok := index.(*ast.Ident)
+		if ok {
+			res = append(res, ident.Name)
+		}
+	}
+
+	return res
+}
+
+// name of the first parameter that can tell the name of the running test
+func FindTestParam(params *ast.FieldList) string {
+	if params == nil {
+		return ""
+	}
+
+	for _, field := range params.List {
+		if len(field.Names) != 1 || field.Names[0].Name == "_" || !IsTestingType(field.Type) {
+			continue
+		}
+
+		return field.Names[0].Name
+	}
+
+	return ""
+}
+
+// *testing.T, *testing.B, *testing.F or testing.TB
+func IsTestingType(expr ast.Expr) bool {
+	star, ok := expr.(*ast.StarExpr)
+	if ok {
+		expr = star.X
+	}
+
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+
+	pkg, ok := sel.X.(*ast.Ident)
+	if !ok || pkg.Name != "testing" {
+		return false
+	}
+
+	switch sel.Sel.Name {
+	case "T", "B", "F":
+		return star != nil
+	case "TB":
+		return star == nil
+	}
+
+	return false
+}
+
 // second return value represents whether to ignore the first or not; ignore if False
-func ExtractFuncInfo(fn *ast.FuncDecl, fset *token.FileSet) (FuncInfo, bool) {
+func ExtractFuncInfo(fn *ast.FuncDecl, fset *token.FileSet) (FuncInfo, bool, error) {
+	var err error
+
 	result := NewFuncInfo(fset)
 
 	// ignore if function body is empty
 	if !IsFuncBodyValid(fn.Body) {
-		return result, false
+		return result, false, nil
 	}
 
 	if fn.Name != nil {
 		result.Name = fn.Name.Name
 	}
 
-	if HasField(fn.Type, "Params") {
-		result.Params = GetParamNames(fn.Type.Params)
+	if fn.Recv != nil && len(fn.Recv.List) != 0 {
+		recv := fn.Recv.List[0]
+		result.Receiver = types.ExprString(recv.Type)
+
+		if len(recv.Names) != 0 {
+			result.RecvName = recv.Names[0].Name
+		}
+
+		result.TypeParams = GetRecvTypeParams(recv.Type)
+	}
+
+	if fn.Type.TypeParams != nil {
+		for _, field := range fn.Type.TypeParams.List {
+			for _, name := range field.Names {
+				result.TypeParams = append(result.TypeParams, name.Name)
+			}
+		}
+	}
+
+	result.DeclPos = fset.PositionFor(fn.Pos(), false)
+
+	err = ExtractBodyInfo(&result, fn.Type, fn.Body, fset)
+	if err != nil {
+		return result, false, err
+	}
+
+	return result, true, nil
+}
+
+// fills in the parameters and log positions of a function body, shared by
+// declared functions and func literals
+func ExtractBodyInfo(result *FuncInfo, fnType *ast.FuncType, body *ast.BlockStmt, fset *token.FileSet) error {
+	result.BodyPos = fset.PositionFor(body.Lbrace, false)
+	result.EndPos = fset.PositionFor(body.Rbrace, false)
+
+	if HasField(fnType, "Params") {
+		result.Params = GetParamNames(fnType.Params)
+		result.ParamTypes = GetFieldTypes(fnType.Params)
+		result.UnnamedParams = FindUnnamedParams(fnType.Params, fset)
 	}
 
-	if HasField(fn.Type, "Results") {
-		result.Returns = GetParamNames(fn.Type.Results)
+	if HasField(fnType, "Results") {
+		result.Returns = GetParamNames(fnType.Results)
+		result.ResultTypes = GetFieldTypes(fnType.Results)
 	}
 
-	if len(fn.Body.List) == 0 {
-		result.EntryLogPos = fset.Position(fn.Body.Lbrace)
+	result.TestParam = FindTestParam(fnType.Params)
+
+	if len(body.List) == 0 {
+		// right after the brace, the body may be on the same line as it
+		result.EntryLogPos = fset.PositionFor(body.Lbrace+1, false)
 	} else {
-		result.EntryLogPos = fset.Position(fn.Body.List[0].Pos())
+		result.EntryLogPos = fset.PositionFor(body.List[0].Pos(), false)
 	}
 
-	result.ExitLogPos = FindReturnStmts(fn, fset)
-	// litter.Dump(result.ExitLogPos)
+	result.ExitLogPos = FindReturnStmts(body, fset)
+	result.Terminations = FindTerminations(body, result.TestParam, fset)
+
+	branches := FindBranches(body, fset)
+	for i := range result.ExitLogPos {
+		result.ExitLogPos[i].Branch = branches[result.ExitLogPos[i].Pos.Offset]
+	}
 
-	lastRet := false                            // assume last stmt in func body is not a return stmt
-	exitLogPos := fset.Position(fn.Body.Rbrace) // in that case, the exit log should be just before the func rbrace
-	if len(fn.Body.List) != 0 {
-		// get the indentation of the last statement in func body
-		tempPos := fset.Position(fn.Body.List[len(fn.Body.List)-1].Pos())
-		exitLogPos.Column = tempPos.Column
+	for i := range result.Terminations {
+		result.Terminations[i].Branch = branches[result.Terminations[i].Pos.Offset]
+	}
+	// litter.Dump(result.ExitLogPos)
 
-		_, lastRet = fn.Body.List[len(fn.Body.List)-1].(*ast.ReturnStmt)
+	lastRet := false                                   // assume last stmt in func body is not a return stmt
+	exitLogPos := fset.PositionFor(body.Rbrace, false) // in that case, the exit log should be just before the func rbrace
+	if len(body.List) != 0 {
+		// panic, os.Exit and log.Fatal get their own exit log
+		lastRet = IsTerminating(body.List[len(body.List)-1], result.TestParam)
 	}
 
-	if len(result.ExitLogPos) == 0 || !lastRet {
+	if !lastRet {
 		// if no return stmts are found in func body
 		//  OR
 		// there are return stmts but the last stmt in the func body is not a return stmt
@@ -179,35 +458,169 @@ func ExtractFuncInfo(fn *ast.FuncDecl, fset *token.FileSet) (FuncInfo, bool) {
 		// }
 
 		// making sure in such cases there is an exit log just before the ending rbrace
-		result.ExitLogPos = append(result.ExitLogPos, exitLogPos)
+		result.ExitLogPos = append(result.ExitLogPos, ExitPoint{Pos: exitLogPos})
+	}
+
+	return nil
+}
+
+// FindFuncLits extracts the func literals started with `go func() {...}()`,
+// `defer func() {...}()` or t.Run(name, func(t *testing.T) {...}) anywhere in
+// body, named after the function around them
+func FindFuncLits(body *ast.BlockStmt, name string, fset *token.FileSet) ([]FuncInfo, error) {
+	var res []FuncInfo
+	var err error
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		if err != nil {
+			return false
+		}
+
+		var call *ast.CallExpr
+		var kind string
+
+		switch stmt := n.(type) {
+		case *ast.GoStmt:
+			call, kind = stmt.Call, KindGoroutine
+		case *ast.DeferStmt:
+			call, kind = stmt.Call, KindDefer
+		case *ast.CallExpr:
+			call, kind = stmt, KindSubtest
+		default:
+			return true
+		}
+
+		var lit *ast.FuncLit
+		if kind == KindSubtest {
+			lit = FindSubtest(call)
+		} else {
+			lit, _ = call.Fun.(*ast.FuncLit)
+		}
+
+		if lit == nil || !IsFuncBodyValid(lit.Body) {
+			return true
+		}
+
+		info := NewFuncInfo(fset)
+		info.Kind = kind
+		info.Name = name
+		info.DeclPos = fset.PositionFor(lit.Pos(), false)
+
+		err = ExtractBodyInfo(&info, lit.Type, lit.Body, fset)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", info.DeclPos, err)
+			return false
+		}
+
+		res = append(res, info)
+		return true
+	})
+
+	return res, err
+}
+
+// ExtractVarFuncInfo handles func literals assigned to package level
+// variables, `var handler = func(...) {...}`, named after the variable
+func ExtractVarFuncInfo(name *ast.Ident, lit *ast.FuncLit, fset *token.FileSet) (FuncInfo, bool, error) {
+	result := NewFuncInfo(fset)
+
+	if !IsFuncBodyValid(lit.Body) || name.Name == "_" {
+		return result, false, nil
+	}
+
+	result.Name = name.Name
+	result.DeclPos = fset.PositionFor(lit.Pos(), false)
+
+	err := ExtractBodyInfo(&result, lit.Type, lit.Body, fset)
+	if err != nil {
+		return result, false, err
 	}
 
-	return result, true
+	return result, true, nil
 }
 
-func GetAllFuncInfo(root *ast.File, fset *token.FileSet) []FuncInfo {
+// the functions declared at the top level of a file, along with their bodies
+func FindTopLevelFuncs(root *ast.File, fset *token.FileSet) ([]FuncInfo, []*ast.BlockStmt, error) {
 	var fnInfo []FuncInfo
+	var bodies []*ast.BlockStmt
 
 	for _, decl := range root.Decls {
-		fn, ok := decl.(*ast.FuncDecl)
-		if !ok {
-			continue
-		}
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			info, ok, err := ExtractFuncInfo(decl, fset)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", fset.Position(decl.Pos()), err)
+			}
 
-		info, ok := ExtractFuncInfo(fn, fset)
-		if !ok {
-			continue
+			if ok {
+				fnInfo = append(fnInfo, info)
+				bodies = append(bodies, decl.Body)
+			}
+		case *ast.GenDecl:
+			if decl.Tok != token.VAR {
+				continue
+			}
+
+			for _, spec := range decl.Specs {
+				valueSpec := spec.(*ast.ValueSpec)
+				if len(valueSpec.Names) != len(valueSpec.Values) {
+					continue
+				}
+
+				for idx, value := range valueSpec.Values {
+					lit, ok := value.(*ast.FuncLit)
+					if !ok {
+						continue
+					}
+
+					info, ok, err := ExtractVarFuncInfo(valueSpec.Names[idx], lit, fset)
+					if err != nil {
+						return nil, nil, fmt.Errorf("%s: %w", fset.Position(lit.Pos()), err)
+					}
+
+					if ok {
+						fnInfo = append(fnInfo, info)
+						bodies = append(bodies, lit.Body)
+					}
+				}
+			}
 		}
+	}
+
+	return fnInfo, bodies, nil
+}
+
+func GetAllFuncInfo(root *ast.File, fset *token.FileSet) ([]FuncInfo, error) {
+	var fnInfo []FuncInfo
+
+	topLevel, bodies, err := FindTopLevelFuncs(root, fset)
+	if err != nil {
+		return nil, err
+	}
 
+	for idx, info := range topLevel {
 		//litter.Dump(info)
 
+		info.Package = root.Name.Name
 		fnInfo = append(fnInfo, info)
+
+		lits, err := FindFuncLits(bodies[idx], DisplayName(info), fset)
+		if err != nil {
+			return nil, err
+		}
+
+		for idx := range lits {
+			lits[idx].Package = info.Package
+		}
+
+		fnInfo = append(fnInfo, lits...)
 	}
 
-	return fnInfo
+	return fnInfo, nil
 }
 
-func GetParamLog(params []string) (string, string, int) {
+// types holds the type of every parameter, if known
+func GetParamLog(params []string, types []string, opts Options) (string, string, int) {
 	paramLog := ""
 	paramValLog := ""
 	count := 0
@@ -216,150 +629,1093 @@ func GetParamLog(params []string) (string, string, int) {
 		return paramLog, paramValLog, count
 	}
 
-	for _, param := range params {
+	for i, param := range params {
 		if param == "" {
 			// not sure how to print unnamed param values
 			continue
 		}
 
-		paramLog += param + ": " + "%+v, "
-		paramValLog += param + ","
+		typ := ""
+		if i < len(types) {
+			typ = types[i]
+		}
+
+		verb, value := FormatValue(param, typ, param, opts)
+		paramLog += param + ": " + verb + ", "
+		paramValLog += value + ","
 		count = count + 1
 	}
 
 	return strings.TrimSuffix(paramLog, ", "), strings.TrimSuffix(paramValLog, ","), count
 }
 
-func GetEntryLogInfo(info FuncInfo) LogInfo {
-	var logInfo LogInfo
+// FindUnnamedParams returns where the type of every parameter starts if none
+// of them has a name, parameters are either all named or all unnamed
+func FindUnnamedParams(params *ast.FieldList, fset *token.FileSet) []token.Position {
+	var res []token.Position
 
-	entryLog := fmt.Sprintf("Starting func %s", info.Name)
-	paramLog, paramValLog, count := GetParamLog(info.Params)
+	if params == nil {
+		return res
+	}
 
-	if count != 0 {
-		entryLog += fmt.Sprintf(" with values: %s", paramLog)
-		logInfo.Log = fmt.Sprintf("fmt.Printf(\"%s\\n\", %s)", entryLog, paramValLog)
-	} else {
-		logInfo.Log = fmt.Sprintf("fmt.Println(\"%s\")", entryLog)
+	for _, field := range params.List {
+		if len(field.Names) != 0 {
+			return nil
+		}
+
+		res = append(res, fset.PositionFor(field.Type.Pos(), false))
 	}
 
-	logInfo.Col = info.EntryLogPos.Column
-	return logInfo
+	return res
 }
 
-func GetExitLogInfo(info FuncInfo, idx int, line int) LogInfo {
-	var logInfo LogInfo
+// the placeholder names of unnamed parameters
+func ArgVars(count int) []string {
+	var res []string
 
-	logInfo.Log = fmt.Sprintf("fmt.Println(\"Exiting func %s from line %d\")", info.Name, line)
-	logInfo.Col = info.ExitLogPos[idx].Column
+	for i := 0; i < count; i++ {
+		res = append(res, fmt.Sprintf("arg%d", i))
+	}
 
-	return logInfo
+	return res
 }
 
-func GenerateLogs(fnInfo []FuncInfo) map[int][]LogInfo {
-	var logs map[int][]LogInfo
-	logs = make(map[int][]LogInfo)
-
-	count := 0
+// the func literal of a t.Run(name, func(t *testing.T) {...}) call
+func FindSubtest(call *ast.CallExpr) *ast.FuncLit {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Run" || len(call.Args) != 2 {
+		return nil
+	}
 
-	for _, info := range fnInfo {
-		logs[info.EntryLogPos.Line] = append(logs[info.EntryLogPos.Line], GetEntryLogInfo(info))
-		count = count + 1
-		for idx, exitLog := range info.ExitLogPos {
-			logs[exitLog.Line] = append(logs[exitLog.Line], GetExitLogInfo(info, idx, exitLog.Line+count))
-			count = count + 1
-		}
+	lit, ok := call.Args[1].(*ast.FuncLit)
+	if !ok || FindTestParam(lit.Type.Params) == "" {
+		return nil
 	}
 
-	return logs
+	return lit
 }
 
-func ReadFileLines(path string) []string {
-	var contents []string
+// name used in the logs, methods are qualified with their receiver type like
+// method expressions: (*Server).Handle
+func DisplayName(info FuncInfo) string {
+	if info.Kind != KindFunc {
+		return info.Kind + " in " + info.Name
+	}
 
-	file, err := os.Open(path)
-	if err != nil {
-		log.Fatal(err)
+	// a package can have any number of init functions, tell them apart by
+	// where they are so the logs show the order packages are initialized in
+	if info.Name == "init" && info.Receiver == "" && info.Package != "" {
+		return fmt.Sprintf("%s.init (%s:%d)", info.Package, filepath.Base(info.DeclPos.Filename), info.DeclPos.Line)
+	}
+
+	if info.Receiver == "" {
+		return info.Name
 	}
 
-	defer file.Close()
+	return fmt.Sprintf("(%s).%s", info.Receiver, info.Name)
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		contents = append(contents, scanner.Text())
+// the name of the function, of the enclosing one for func literals, with
+// -qualified prefixed with the package so same named functions of different
+// packages can be told apart: store.(*DB).Get
+func QualifiedName(info FuncInfo, opts Options) string {
+	name := info.Name
+	if info.Kind == KindFunc {
+		name = DisplayName(info)
 	}
 
-	if scanner.Err() != nil {
-		log.Fatal(scanner.Err())
+	// init functions carry their package already
+	if opts.Qualified && info.Package != "" && !strings.HasPrefix(name, info.Package+".") {
+		name = info.Package + "." + name
 	}
 
-	return contents
+	return name
 }
 
-func WriteLogsToFile(path string, contents []string, logs map[int][]LogInfo) {
-	file, err := os.Create(path)
-	if err != nil {
-		log.Fatal(err)
+// RuntimeKey identifies the function to the runtime: its name qualified with
+// the package, for func literals followed by their kind
+func RuntimeKey(info FuncInfo) string {
+	key := QualifiedName(info, Options{Qualified: true})
+	if info.Kind != KindFunc {
+		key += " " + info.Kind
 	}
 
-	defer file.Close()
+	return key
+}
 
-	wr := bufio.NewWriter(file)
-	for idx, line := range contents {
-		infos, ok := logs[idx+1]
-		if ok {
-			for _, info := range infos {
-				// go uses tabs for indentation
-				indent := strings.Repeat("\t", info.Col-1)
-				logLine := fmt.Sprintf("%s%s", indent, info.Log)
-				fmt.Fprintln(wr, logLine)
-			}
+// what the logs call the function: func Foo, goroutine in Foo
+func LogLabel(info FuncInfo, opts Options) string {
+	name := QualifiedName(info, opts)
+	if info.Kind == KindFunc {
+		return "func " + name
+	}
+
+	return info.Kind + " in " + name
+}
+
+// how -receiver-format logs the receiver
+const (
+	ReceiverValue    = "value"    // %+v of the whole value
+	ReceiverExported = "exported" // only the exported fields, through the runtime
+	ReceiverType     = "type"     // only its type
+	ReceiverPointer  = "pointer"  // the address of pointer receivers, the type of the others
+)
+
+// GetReceiverLog is the part of the entry log showing the receiver of a
+// method with -log-receiver, ok is false if it is not logged
+func GetReceiverLog(info FuncInfo, opts Options) (string, string, bool) {
+	recv := info.RecvName
+	if !opts.LogReceiver || recv == "" || recv == "_" {
+		return "", "", false
+	}
+
+	switch opts.ReceiverFormat {
+	case ReceiverType:
+		return recv + ": %T", recv, true
+	case ReceiverPointer:
+		if strings.HasPrefix(info.Receiver, "*") {
+			return recv + ": %p", recv, true
 		}
 
-		fmt.Fprintln(wr, line)
+		return recv + ": %T", recv, true
 	}
 
-	err = wr.Flush()
-	if err != nil {
-		log.Fatal(err)
+	// formatting the receiver would call the method being logged again
+	if IsFormatterMethod(info.Name) {
+		return "", "", false
+	}
+
+	if opts.ReceiverFormat == ReceiverExported {
+		verb, value := FormatValue(recv, info.Receiver, RuntimeName+".Exported("+recv+")", opts)
+		return recv + ": " + verb, value, true
 	}
+
+	verb, value := FormatValue(recv, info.Receiver, recv, opts)
+	return recv + ": " + verb, value, true
+}
+
+// fmt calls these to format the receiver, logging the receiver with %+v from
+// inside them would recurse forever
+func IsFormatterMethod(name string) bool {
+	switch name {
+	case "String", "GoString", "Error", "Format":
+		return true
+	}
+
+	return false
 }
 
-func GetNewPath(path string) string {
-	var name string
-	var dir string
-	var newName string
+// the instantiation of a generic function, [T=%T, U=%T] with the zero value
+// of every type parameter as the argument. Interface types print as <nil>.
+func GetTypeParamLog(typeParams []string) (string, string, int) {
+	var names []string
+	var values []string
+
+	for _, typeParam := range typeParams {
+		if typeParam == "_" {
+			continue
+		}
+
+		names = append(names, typeParam+"=%T")
+		values = append(values, "*new("+typeParam+")")
+	}
+
+	if len(names) == 0 {
+		return "", "", 0
+	}
+
+	return "[" + strings.Join(names, ", ") + "]", strings.Join(values, ","), len(names)
+}
 
-	name = filepath.Base(path)
-	dir = filepath.Dir(path)
+// GetTypeParamLog for the structured formats, a type.T field per type
+// parameter
+func GetTypeParamFields(typeParams []string) []Field {
+	var fields []Field
 
-	newName = fmt.Sprintf("debug_%s", name)
+	for _, typeParam := range typeParams {
+		if typeParam != "_" {
+			fields = append(fields, Field{Key: "type." + typeParam, Verb: "%T", Expr: "*new(" + typeParam + ")"})
+		}
+	}
 
-	return dir + "/" + newName
+	return fields
 }
 
-func AddLogsToFile(root *ast.File, fset *token.FileSet, filePath string) {
-	allFuncInfo := GetAllFuncInfo(root, fset)
+func GetEntryLogInfo(info FuncInfo, opts Options) LogInfo {
+	var logInfo LogInfo
+
+	var params, types, blanks []string
+	for i, param := range info.Params {
+		// blank parameters have no value to refer to, only their type is logged
+		if param == "_" {
+			blanks = append(blanks, info.ParamTypes[i])
+			continue
+		}
+
+		// dumping a *testing.T is noise, its name is logged instead
+		if param != info.TestParam {
+			params = append(params, param)
+			types = append(types, info.ParamTypes[i])
+		}
+	}
+
+	if len(info.UnnamedParams) != 0 && opts.NameParams {
+		params, types = ArgVars(len(info.UnnamedParams)), info.ParamTypes
+	}
+
+	msg := Message{Event: EventEnter, Text: GetMessage("entry-template", opts.EntryTemplate, info, info.DeclPos.Line, opts), Gated: IsCallGated(info, opts), Func: RuntimeKey(info)}
+	msg.Fields = GetFuncFields(info, opts)
+
+	typeLog, typeValLog, typeCount := GetTypeParamLog(info.TypeParams)
+	if typeCount != 0 {
+		msg.Add(typeLog, typeValLog)
+		msg.Fields = append(msg.Fields, GetTypeParamFields(info.TypeParams)...)
+	}
+
+	if opts.CallIDs {
+		msg.Add(" #%d", CallVar)
+		msg.AddField("call", "%d", CallVar)
+	}
+
+	if opts.CountCalls {
+		count := fmt.Sprintf("%s.CountCall(%s)", RuntimeName, strconv.Quote(RuntimeKey(info)))
+		msg.Add(" (call #%d)", count)
+		msg.AddField("count", "%d", count)
+	}
+
+	paramLog, paramValLog, count := GetParamLog(params, types, opts)
+
+	recvLog, recvValLog, ok := GetReceiverLog(info, opts)
+	if ok && count != 0 {
+		paramLog = recvLog + ", " + paramLog
+		paramValLog = recvValLog + "," + paramValLog
+		count = count + 1
+	} else if ok {
+		paramLog, paramValLog, count = recvLog, recvValLog, 1
+	}
+
+	if count != 0 {
+		msg.Add(" with values: "+paramLog, paramValLog)
+	}
+
+	if ok {
+		verb := strings.TrimPrefix(recvLog, info.RecvName+": ")
+		if verb == "%s" {
+			verb = "%q"
+		}
+
+		msg.AddField("recv", verb, recvValLog)
+	}
+
+	msg.Fields = append(msg.Fields, GetValueFields("param.", params, params, types, opts)...)
+
+	// without names there is nothing to print the values with
+	if len(info.UnnamedParams) != 0 && !opts.NameParams {
+		msg.Add(fmt.Sprintf(" with unnamed parameters: %s", strings.Join(info.ParamTypes, ", ")))
+		msg.AddValue("unnamed", strings.Join(info.ParamTypes, ","))
+	}
+
+	if len(blanks) != 0 {
+		msg.Add(fmt.Sprintf(" with blank parameters: %s", strings.Join(blanks, ", ")))
+		msg.AddValue("blank", strings.Join(blanks, ","))
+	}
+
+	if opts.Caller {
+		msg.Add(" (called from %s)", RuntimeName+".Caller()")
+		msg.AddField("caller", "%q", RuntimeName+".Caller()")
+	}
+
+	if info.TestParam != "" {
+		msg.Add(" (test %s)", info.TestParam+".Name()")
+		msg.AddField("test", "%q", info.TestParam+".Name()")
+	}
 
-	logs := GenerateLogs(allFuncInfo)
-	newFilePath := GetNewPath(filePath)
+	logInfo.Log = FormatLog(msg, opts)
+	logInfo.Col = info.EntryLogPos.Column
+	return logInfo
+}
 
-	fmt.Printf("\n\nold path: %s, new path: %s\n\n", filePath, newFilePath)
-	contents := ReadFileLines(filePath)
+// the named results of a function that can be logged and their types, blank
+// ones have no value to refer to
+func GetNamedResults(info FuncInfo) ([]string, []string) {
+	var res, types []string
 
-	WriteLogsToFile(newFilePath, contents, logs)
+	for i, name := range info.Returns {
+		if name != "" && name != "_" {
+			res = append(res, name)
+			types = append(types, info.ResultTypes[i])
+		}
+	}
 
-	fmt.Println("finished writing to file")
+	return res, types
 }
 
-func main() {
-	var fileName string
-	var root *ast.File
-	var fset *token.FileSet
+// the line is the one of the exit point in the original source, it does not
+// depend on how many logs end up above it
+func GetExitLogInfo(info FuncInfo, point ExitPoint, opts Options) LogInfo {
+	var logInfo LogInfo
 
-	fileName = os.Args[2]
-	root, fset = GenerateAST(fileName)
+	msg := Message{Event: EventExit, Text: GetMessage("exit-template", opts.ExitTemplate, info, point.Pos.Line, opts), Gated: IsCallGated(info, opts), Func: RuntimeKey(info)}
+	msg.Fields = GetFuncFields(info, opts)
+	msg.AddInt("line", point.Pos.Line)
 
-	// ast.Print(fset, root)
-	AddLogsToFile(root, fset, fileName)
+	if opts.CallIDs {
+		msg.Add(" #%d", CallVar)
+		msg.AddField("call", "%d", CallVar)
+	}
+
+	if opts.Durations {
+		msg.Add(" after %v", RuntimeName+".Since("+StartVar+")")
+		msg.Fields = append(msg.Fields, Field{Key: "elapsed", Verb: "%v", Expr: RuntimeName + ".Since(" + StartVar + ")", Type: "time.Duration"})
+	}
+
+	if point.Kind != "" {
+		msg.Add(fmt.Sprintf(" (%s)", point.Kind))
+		msg.AddValue("through", point.Kind)
+	}
+
+	// quoted as arguments, the source may contain quotes and verbs
+	if point.Source != "" {
+		msg.Add(" (%s)", strconv.Quote(point.Source))
+		msg.AddField("source", "%q", strconv.Quote(point.Source))
+	}
+
+	if point.Branch != "" {
+		msg.Add(" (branch: %s)", strconv.Quote(point.Branch))
+		msg.AddField("branch", "%q", strconv.Quote(point.Branch))
+	}
+
+	// a naked return hands back whatever the named results hold right now,
+	// the values of any other return are handed to the wrapper around them
+	var labels, vars, types []string
+	if point.Naked {
+		labels, types = GetNamedResults(info)
+		vars = labels
+	} else if point.ValuesPos.IsValid() {
+		labels, vars, types = info.Returns, ResultVars(len(info.ResultTypes)), info.ResultTypes
+	}
+
+	resultLog, resultValLog, count := GetResultLog(labels, vars, types, opts)
+	if count != 0 {
+		msg.Add(" with results: "+resultLog, resultValLog)
+		msg.Fields = append(msg.Fields, GetValueFields("result.", labels, vars, types, opts)...)
+	}
+
+	if info.TestParam != "" {
+		msg.Add(" (test %s)", info.TestParam+".Name()")
+		msg.AddField("test", "%q", info.TestParam+".Name()")
+	}
+
+	logInfo.Log = FormatLog(msg, opts)
+	logInfo.Col = point.Pos.Column
+
+	return logInfo
+}
+
+// the variables -time keeps the start of a call in and -call-id its number
+const (
+	StartVar = "funclogStart"
+	CallVar  = "funclogCall"
+)
+
+// GenerateLogs numbers the logs in the order they are made, which is the order
+// logs at the same column end up in: the functions in fnInfo come outer before
+// inner, and the logs of one function set up the call, log the entry and then
+// the exits.
+func GenerateLogs(fnInfo []FuncInfo, opts Options) map[int][]LogInfo {
+	var logs map[int][]LogInfo
+	logs = make(map[int][]LogInfo)
+
+	seq := 0
+	add := func(line int, infos ...LogInfo) {
+		for _, info := range infos {
+			seq = seq + 1
+			info.Seq = seq
+			logs[line] = append(logs[line], info)
+		}
+	}
+
+	for _, info := range fnInfo {
+		if opts.NameParams {
+			for i, pos := range info.UnnamedParams {
+				add(pos.Line, LogInfo{Log: fmt.Sprintf("arg%d", i), Col: pos.Column, Inline: true})
+			}
+		}
+
+		// before the first log, it may turn logging on
+		if opts.Signals {
+			handle := LogInfo{Log: fmt.Sprintf("%s.HandleSignals(%t)", RuntimeName, !opts.KillSwitch), Col: info.EntryLogPos.Column}
+			add(info.EntryLogPos.Line, handle)
+		}
+
+		if opts.ProcessInfo == ProcessInfoOnce {
+			add(info.EntryLogPos.Line, GetProcessLog(info, opts))
+		}
+
+		if opts.CallIDs {
+			call := LogInfo{Log: CallVar + " := " + RuntimeName + ".NextCall()", Col: info.EntryLogPos.Column}
+			add(info.EntryLogPos.Line, call)
+		}
+
+		// the deferred Leave runs after every exit log
+		if opts.Indent {
+			enter := LogInfo{Log: RuntimeName + ".Enter()", Col: info.EntryLogPos.Column}
+			leave := LogInfo{Log: "defer " + RuntimeName + ".Leave()", Col: info.EntryLogPos.Column}
+			add(info.EntryLogPos.Line, enter, leave)
+		}
+
+		if IsCallGated(info, opts) {
+			add(info.EntryLogPos.Line, GetCallGateLog(info, opts))
+		}
+
+		add(info.EntryLogPos.Line, GetEntryLogInfo(info, opts))
+
+		// an unused variable would not compile, functions that never return
+		// have nothing to log the duration at
+		if opts.Durations && len(info.ExitLogPos)+len(info.Terminations) != 0 {
+			start := LogInfo{Log: StartVar + " := " + RuntimeName + ".Start()", Col: info.EntryLogPos.Column}
+			add(info.EntryLogPos.Line, start)
+		}
+
+		if IsProgramMain(info) {
+			add(info.EntryLogPos.Line, GetLifecycleLogs(info, opts)...)
+		}
+
+		if opts.Recover {
+			add(info.EntryLogPos.Line, GetRecoverLog(info, opts))
+		}
+
+		// deferred after the handler of -recover, the calls leading up to a
+		// panic are dumped before it is logged
+		if opts.Ring > 0 {
+			dump := LogInfo{Log: "defer " + RuntimeName + ".DumpOnPanic()", Col: info.EntryLogPos.Column}
+			add(info.EntryLogPos.Line, dump)
+		}
+
+		for _, point := range info.ExitLogPos {
+			exitLog := GetExitLogInfo(info, point, opts)
+			if errResult := ErrorResult(info, point); opts.ExitErrors && errResult != "" {
+				exitLog.Log = fmt.Sprintf("if %s != nil { %s }", errResult, exitLog.Log)
+			}
+			if !point.ValuesPos.IsValid() {
+				add(point.Pos.Line, exitLog)
+				continue
+			}
+
+			wrapper := GetReturnWrapper(info, exitLog.Log)
+			add(point.ValuesPos.Line, LogInfo{Log: wrapper, Col: point.ValuesPos.Column, Inline: true})
+		}
+
+		for _, point := range info.Terminations {
+			add(point.Pos.Line, GetExitLogInfo(info, point, opts))
+
+			if IsProgramMain(info) && EndsProgram(point) {
+				add(point.Pos.Line, GetExitCallLog(point, opts))
+			}
+		}
+	}
+
+	return logs
+}
+
+// ReadLines splits what r reads into lines without their \n or \r\n endings,
+// however long they are. A missing final newline is not an extra line.
+func ReadLines(r io.Reader) ([]string, error) {
+	var contents []string
+
+	rd := bufio.NewReader(r)
+	for {
+		line, err := rd.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(line, "\n")
+			contents = append(contents, strings.TrimSuffix(line, "\r"))
+		}
+
+		if err == io.EOF {
+			return contents, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// src is the file the result takes its permissions (and with -keep-mtime its
+// modification time) from
+func WriteLinesToFile(path string, src string, contents []string, opts Options) error {
+	return WriteFileAtomic(path, src, opts.KeepMtime, func(w io.Writer) error {
+		_, err := w.Write(opts.LineStyle.Apply([]byte(JoinLines(contents))))
+		return err
+	})
+}
+
+// JoinLines is contents with every line ended by \n
+func JoinLines(contents []string) string {
+	if len(contents) == 0 {
+		return ""
+	}
+
+	return strings.Join(contents, "\n") + "\n"
+}
+
+// FormatLogs is the source of root with the logs injected into its syntax
+// tree and printed like gofmt, guarded by the -build-tag of opts and with the
+// //line directives of opts. name is what the errors call the copy. A file
+// indented with spaces stays indented with them.
+func FormatLogs(name string, root *ast.File, fset *token.FileSet, logs map[int][]LogInfo, opts Options) ([]byte, error) {
+	file, err := InjectLogs(root, fset, logs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	src, err := PrintLogs(file)
+	if err != nil {
+		return nil, fmt.Errorf("formatting %s: %w", name, err)
+	}
+
+	src = UnindentLineDirectives(src, root, fset)
+
+	if opts.BuildTag != "" {
+		src, err = GuardSource(src, opts.BuildTag)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if opts.LineFile != "" {
+		src, err = AddLineDirectives(src, root, fset, opts.LineFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return Reindent(src, opts.LineStyle.Indent), nil
+}
+
+// FormatSource formats src like gofmt, name is what the errors call it. A
+// file indented with spaces stays indented with indent.
+func FormatSource(name string, src []byte, indent string) ([]byte, error) {
+	fset := token.NewFileSet()
+
+	root, err := parser.ParseFile(fset, name, src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	err = format.Node(&buf, fset, root)
+	if err != nil {
+		return nil, fmt.Errorf("formatting %s: %w", name, err)
+	}
+
+	return Reindent(buf.Bytes(), indent), nil
+}
+
+// byte for byte copy, so the backup is exactly what was on disk
+func WriteBackup(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path+".orig", path, true, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// the copy is written next to path, ./file.go and file.go name the same one
+func GetNewPath(path string, tmpl string) (string, error) {
+	newName, err := ExpandName(tmpl, filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(path), newName), nil
+}
+
+// PrintDiff writes the diff of old against src
+func PrintDiff(w io.Writer, oldName string, newName string, old []string, src []byte) error {
+	contents, err := ReadLines(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(w, UnifiedDiff(oldName, newName, old, contents))
+	return nil
+}
+
+// base is the directory filePath was found under, it anchors the -outdir mirror
+func GetOutputPath(filePath string, base string, opts Options) (string, error) {
+	if opts.InPlace {
+		return filePath, nil
+	}
+
+	if opts.OverlayDir != "" {
+		return OverlayPath(opts.OverlayDir, filePath)
+	}
+
+	if opts.OutDir == "" {
+		return GetNewPath(filePath, opts.NameTemplate)
+	}
+
+	if !IsUnder(filePath, base) {
+		return "", fmt.Errorf("%s is not under %s, cannot mirror it into %s", filePath, base, opts.OutDir)
+	}
+
+	absBase, _ := filepath.Abs(base)
+	absPath, _ := filepath.Abs(filePath)
+	rel, _ := filepath.Rel(absBase, absPath)
+
+	return filepath.Join(opts.OutDir, rel), nil
+}
+
+// true if path is inside dir (or is dir itself)
+func IsUnder(path string, dir string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// with -since only the functions whose bodies changed are kept, with
+// -interactive only the picked ones
+func FilterFuncInfo(allFuncInfo []FuncInfo, filePath string, opts Options) []FuncInfo {
+	var res []FuncInfo
+
+	for _, info := range allFuncInfo {
+		if info.Kind == KindGoroutine && !opts.Goroutines {
+			continue
+		}
+
+		if info.Kind == KindDefer && !opts.Defers {
+			continue
+		}
+
+		if info.Kind == KindSubtest && !opts.Filter.Tests {
+			continue
+		}
+
+		if opts.Changes != nil && !opts.Changes.Touches(filePath, info.BodyPos.Line, info.EndPos.Line) {
+			continue
+		}
+
+		if opts.Selected != nil && !opts.Selected[FuncKey(filePath, info)] {
+			continue
+		}
+
+		res = append(res, info)
+	}
+
+	return res
+}
+
+func AddLogsToFile(root *ast.File, fset *token.FileSet, filePath string, newFilePath string, contents []string, opts Options, out *Output) error {
+	allFuncInfo, err := GetAllFuncInfo(root, fset)
+	if err != nil {
+		return err
+	}
+
+	allFuncInfo = FilterFuncInfo(allFuncInfo, filePath, opts)
+
+	opts.ImportNames = LogImportNames(root)
+	logs := GenerateLogs(allFuncInfo, opts)
+	AddLogImports(logs, root, fset, opts)
+
+	if opts.LineDirectives {
+		absPath, err := filepath.Abs(filePath)
+		if err != nil {
+			return err
+		}
+
+		opts.LineFile = filepath.ToSlash(absPath)
+	}
+
+	original := contents
+	if opts.BuildTag != "" {
+		original, err = GuardLines(contents, fset.PositionFor(root.Package, false).Line, opts.BuildTag, true)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+	}
+
+	src, err := FormatLogs(newFilePath, root, fset, logs, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		if opts.BuildTag != "" {
+			err = PrintDiff(&out.Stdout, filePath, filePath, contents, []byte(JoinLines(original)))
+			if err != nil {
+				return err
+			}
+		}
+
+		return PrintDiff(&out.Stdout, filePath, newFilePath, contents, src)
+	}
+
+	if !opts.Quiet {
+		fmt.Fprintf(&out.Stderr, "\n\nold path: %s, new path: %s\n\n", filePath, newFilePath)
+	}
+
+	if opts.InPlace && opts.Backup {
+		err = WriteBackup(filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(newFilePath), 0o755)
+	if err != nil {
+		return err
+	}
+
+	err = WriteFileAtomic(newFilePath, filePath, opts.KeepMtime, func(w io.Writer) error {
+		_, err := w.Write(opts.LineStyle.Apply(src))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.BuildTag != "" {
+		err = GuardOriginal(filePath, original, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !opts.Quiet {
+		fmt.Fprintln(&out.Stderr, "finished writing to file")
+	}
+	return nil
+}
+
+// PrepareSource applies the -if-instrumented policy to src. It returns the
+// lines and source to instrument, or ok false if the file is to be left alone.
+func PrepareSource(name string, src []byte, opts Options) ([]string, []byte, bool, error) {
+	contents, err := ReadLines(bytes.NewReader(src))
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if !IsInstrumented(contents) {
+		return contents, src, true, nil
+	}
+
+	switch opts.IfInstrumented {
+	case IfInstrumentedRefresh:
+		contents, _ = StripContents(contents)
+		return contents, []byte(JoinLines(contents)), true, nil
+	case IfInstrumentedError:
+		return nil, nil, false, fmt.Errorf("%s: already instrumented", name)
+	}
+
+	return contents, src, false, nil
+}
+
+func InstrumentFile(filePath string, newFilePath string, opts Options, out *Output) error {
+	// nothing to instrument in a file -since did not touch
+	if opts.Changes != nil && !opts.Changes.FileChanged(filePath) {
+		return nil
+	}
+
+	src, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	opts.LineStyle = GetLineStyle(src)
+
+	contents, src, ok, err := PrepareSource(filePath, TrimBOM(src), opts)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		fmt.Fprintf(&out.Stderr, "skipping %s, it is already instrumented\n", filePath)
+		return nil
+	}
+
+	root, fset, err := GenerateAST(filePath, src)
+	if err != nil {
+		return err
+	}
+
+	// ast.Print(fset, root)
+	return AddLogsToFile(root, fset, filePath, newFilePath, contents, opts, out)
+}
+
+// skip non go files and the debug_ copies written by a previous run
+func IsInstrumentable(path string) bool {
+	name := filepath.Base(path)
+
+	return strings.HasSuffix(name, ".go") && !strings.HasPrefix(name, "debug_")
+}
+
+func FindGoFiles(dir string, filter FileFilter) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if path != dir && !filter.MatchDir(rel) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !IsInstrumentable(path) || !filter.MatchFile(path, rel) {
+			return nil
+		}
+
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// files named explicitly are never filtered, only the ones found by walking a
+// directory or expanding a package pattern
+func ResolveFiles(path string, filter FileFilter) ([]string, error) {
+	if IsPackagePattern(path) {
+		return FindPackageFiles(path, filter)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{filepath.Clean(path)}, nil
+	}
+
+	return FindGoFiles(path, filter)
+}
+
+// reads the source from stdin and writes the instrumented source to stdout
+func InstrumentStdin(opts Options) error {
+	src, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	out, ok, err := InstrumentSource("<standard input>", src, opts)
+	if err != nil {
+		return err
+	}
+
+	// a filter has to hand back something, pass the source through untouched
+	if !ok {
+		if opts.DryRun {
+			return nil
+		}
+
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+
+	if opts.DryRun {
+		old, err := ReadLines(bytes.NewReader(TrimBOM(src)))
+		if err != nil {
+			return err
+		}
+
+		contents, err := ReadLines(bytes.NewReader(TrimBOM(out)))
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(UnifiedDiff("<standard input>", "<standard output>", old, contents))
+		return nil
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// InstrumentSource returns src with the logs injected, as instrument writes it
+// for a single file, or ok false if src is to be left alone
+func InstrumentSource(name string, src []byte, opts Options) ([]byte, bool, error) {
+	opts.LineStyle = GetLineStyle(src)
+
+	_, prepared, ok, err := PrepareSource(name, TrimBOM(src), opts)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	root, fset, err := GenerateAST(name, prepared)
+	if err != nil {
+		return nil, false, err
+	}
+
+	allFuncInfo, err := GetAllFuncInfo(root, fset)
+	if err != nil {
+		return nil, false, err
+	}
+
+	allFuncInfo = FilterFuncInfo(allFuncInfo, name, opts)
+
+	opts.ImportNames = LogImportNames(root)
+	logs := GenerateLogs(allFuncInfo, opts)
+	AddLogImports(logs, root, fset, opts)
+
+	out, err := FormatLogs(name, root, fset, logs, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return opts.LineStyle.Apply(out), true, nil
+}
+
+type Target struct {
+	Path    string // file to instrument
+	OutPath string // where the instrumented copy goes
+}
+
+// ResolveTargets pairs every file path resolves to with its output path
+func ResolveTargets(path string, opts Options) ([]Target, error) {
+	// files given directly or through a package pattern are mirrored relative
+	// to the working directory, directories relative to themselves
+	base := "."
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		base = path
+	}
+
+	files, err := ResolveFiles(path, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.InPlace && opts.OutDir == "" && opts.OverlayDir == "" {
+		files = DropCopies(files, opts.NameTemplate)
+	}
+
+	var targets []Target
+	for _, filePath := range files {
+		// don't pick up the output of an earlier run
+		if opts.OutDir != "" && IsUnder(filePath, opts.OutDir) {
+			continue
+		}
+
+		newFilePath, err := GetOutputPath(filePath, base, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		targets = append(targets, Target{Path: filePath, OutPath: newFilePath})
+	}
+
+	return targets, nil
+}
+
+func InstrumentTargets(targets []Target, opts Options) error {
+	return ProcessTargets(targets, opts.Jobs, func(target Target, out *Output) error {
+		return InstrumentFile(target.Path, target.OutPath, opts, out)
+	})
+}
+
+// ProcessTargets hands the targets to a pool of workers running fn. Output is
+// flushed in target order as soon as all earlier targets are done, and a file
+// that fails does not stop the others, all failures are returned joined.
+func ProcessTargets(targets []Target, jobs int, fn func(target Target, out *Output) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	outputs := make([]Output, len(targets))
+	errs := make([]error, len(targets))
+
+	queue := make(chan int)
+	done := make(chan int)
+
+	for w := 0; w < jobs; w++ {
+		go func() {
+			for idx := range queue {
+				errs[idx] = fn(targets[idx], &outputs[idx])
+				done <- idx
+			}
+		}()
+	}
+
+	go func() {
+		for idx := range targets {
+			queue <- idx
+		}
+
+		close(queue)
+	}()
+
+	finished := make([]bool, len(targets))
+	next := 0
+	for range targets {
+		finished[<-done] = true
+		for next < len(targets) && finished[next] {
+			outputs[next].Flush()
+			next++
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func InstrumentPath(path string, opts Options) error {
+	if path == "-" {
+		return InstrumentStdin(opts)
+	}
+
+	targets, err := ResolveTargets(path, opts)
+	if err != nil {
+		return err
+	}
+
+	return InstrumentTargets(targets, opts)
+}
+
+func main() {
+	// `go run main.go -- <path>` hands us the -- as the first argument
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	err := RunCLI(args)
+
+	// a failing go command already explained itself on stderr
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	os.Exit(ExitCode(err))
 }
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// instrument runs src through InstrumentSource with the defaults of the
+// instrument command and the given flags
+func instrument(t *testing.T, src string, args ...string) string {
+	t.Helper()
+
+	var opts Options
+	fs := NewFlagSet(FindCommand("instrument"))
+	AddInstrumentFlags(fs, &opts)
+
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, ok, err := InstrumentSource("test.go", []byte(src), opts)
+	if err != nil {
+		t.Fatalf("instrumenting failed: %v\n%s", err, src)
+	}
+
+	if !ok {
+		t.Fatalf("source was left alone:\n%s", src)
+	}
+
+	return string(out)
+}
+
+func TestExitLines(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "one exit per function",
+			src: `package p
+
+func a() {
+}
+
+func b() int {
+	return 1
+}
+
+func c() {
+	println()
+}
+`,
+			want: []string{
+				"Exiting func a from line 4",
+				"Exiting func b from line 7",
+				"Exiting func c from line 12",
+			},
+		},
+		{
+			name: "several exits in several functions",
+			src: `package p
+
+func a(x int) int {
+	if x > 0 {
+		return 1
+	}
+
+	return 2
+}
+
+func b(x int) {
+	if x > 0 {
+		return
+	}
+
+	println(x)
+}
+`,
+			want: []string{
+				"Exiting func a from line 5",
+				"Exiting func a from line 8",
+				"Exiting func b from line 13",
+				"Exiting func b from line 17",
+			},
+		},
+		{
+			name: "exits after func literals and compact bodies",
+			src: `package p
+
+func a() int { return 1 }
+
+func b() {
+	defer func() {
+		println()
+	}()
+}
+
+func c() (int, error) { return 0, nil }
+`,
+			want: []string{
+				"Exiting func a from line 3",
+				"Exiting func b from line 9",
+				"Exiting func c from line 11",
+			},
+		},
+		{
+			name: "panics and os.Exit count as exits",
+			src: `package p
+
+import "os"
+
+func a() {
+	panic("a")
+}
+
+func b(code int) {
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+`,
+			want: []string{
+				"Exiting func a from line 6 (panic)",
+				"Exiting func b from line 11 (os.Exit)",
+				"Exiting func b from line 13",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := instrument(t, test.src)
+
+			var got []string
+			for _, line := range strings.Split(out, "\n") {
+				idx := strings.Index(line, "Exiting func ")
+				if idx < 0 {
+					continue
+				}
+
+				got = append(got, line[idx:])
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d exit logs, want %d:\n%s", len(got), len(test.want), out)
+			}
+
+			for i, want := range test.want {
+				if !strings.HasPrefix(got[i], want) {
+					t.Errorf("exit log %d is %q, want it to start with %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{name: "trailing newline", src: "a\nb\n", want: []string{"a", "b"}},
+		{name: "no trailing newline", src: "a\nb", want: []string{"a", "b"}},
+		{name: "crlf", src: "a\r\nb\r\n", want: []string{"a", "b"}},
+		{name: "empty lines", src: "\n\na", want: []string{"", "", "a"}},
+		{name: "longer than 64 KiB", src: "a\n" + long + "\nb", want: []string{"a", long, "b"}},
+		{name: "ending with a long line", src: long, want: []string{long}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ReadLines(strings.NewReader(test.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d lines, want %d", len(got), len(test.want))
+			}
+
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("line %d: got %.20q (%d bytes), want %.20q (%d bytes)", i+1, got[i], len(got[i]), test.want[i], len(test.want[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestInstrumentLongLines(t *testing.T) {
+	data := strings.Repeat("x", 100*1024)
+
+	src := "package p\n\nconst data = \"" + data + "\"\n\nfunc f() string {\n\treturn data\n}"
+
+	out := instrument(t, src)
+	if !strings.Contains(out, "const data = \""+data+"\"\n") {
+		t.Errorf("the long line did not make it into the copy")
+	}
+
+	if !strings.Contains(out, `"Exiting func f from line 6`) {
+		t.Errorf("no exit log in\n%.300s", out)
+	}
+}
+
+func TestGetNewPath(t *testing.T) {
+	abs, err := filepath.Abs("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "file.go", want: "debug_file.go"},
+		{path: "./file.go", want: "debug_file.go"},
+		{path: "pkg/sub/file.go", want: "pkg/sub/debug_file.go"},
+		{path: "./pkg/sub/../file.go", want: "pkg/debug_file.go"},
+		{path: "../pkg/file.go", want: "../pkg/debug_file.go"},
+		{path: filepath.Join(abs, "file.go"), want: filepath.Join(abs, "debug_file.go")},
+	}
+
+	if runtime.GOOS == "windows" {
+		tests = append(tests,
+			struct{ path, want string }{path: `C:\src\file.go`, want: `C:\src\debug_file.go`},
+			struct{ path, want string }{path: `.\pkg\file.go`, want: `pkg\debug_file.go`},
+		)
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got, err := GetNewPath(filepath.FromSlash(test.path), DefaultNameTemplate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := filepath.FromSlash(test.want); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestGetOutputPath(t *testing.T) {
+	tests := []struct {
+		path string
+		base string
+		want string
+	}{
+		{path: "file.go", base: ".", want: "out/file.go"},
+		{path: "./pkg/sub/file.go", base: ".", want: "out/pkg/sub/file.go"},
+		{path: "pkg/sub/file.go", base: "./pkg", want: "out/sub/file.go"},
+		{path: "pkg/../file.go", base: ".", want: "out/file.go"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			opts := Options{OutDir: "out", NameTemplate: DefaultNameTemplate}
+
+			got, err := GetOutputPath(filepath.FromSlash(test.path), filepath.FromSlash(test.base), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := filepath.FromSlash(test.want); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+
+	_, err := GetOutputPath("../file.go", ".", Options{OutDir: "out"})
+	if err == nil {
+		t.Errorf("a file outside of the base got mirrored")
+	}
+}
+
+// writeFiles writes files, keyed by slash separated paths, below dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(path, []byte(src), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindGoFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"go.mod":             "module example.com/m\n\ngo 1.22\n",
+		"main.go":            "package main\n\nfunc main() {}\n",
+		"sub/sub.go":         "package sub\n",
+		"sub/sub_test.go":    "package sub\n",
+		"vendor/v/v.go":      "package v\n",
+		"testdata/t.go":      "package t\n",
+		".hidden/h.go":       "package h\n",
+		"_build/b.go":        "package b\n",
+		"sub/debug_sub.go":   "package sub\n",
+		"sub/_skipped/s.go":  "package s\n",
+		"sub/testdata/t2.go": "package t\n",
+	}
+
+	writeFiles(t, dir, files)
+
+	// the copy -time and the other runtime flags put into the module
+	_, err := WriteRuntime(filepath.Join(dir, DepDir, RuntimeName), Options{HTTPHandler: true, RuntimeImport: "example.com/m/" + DepDir + "/" + RuntimeName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := FindGoFiles(dir, FileFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(dir, "main.go"), filepath.Join(dir, "sub", "sub.go")}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInstrumentFuncLits(t *testing.T) {
+	src := `package p
+
+import "testing"
+
+func f() {
+	go func() {}()
+	defer func() {}()
+}
+
+func TestF(t *testing.T) {
+	t.Run("sub", func(t *testing.T) {})
+}
+`
+
+	tests := []struct {
+		args []string
+		want []string
+		not  []string
+	}{
+		{
+			not: []string{"goroutine in f", "deferred func in f", "subtest in TestF"},
+		},
+		{
+			args: []string{"-goroutines"},
+			want: []string{"goroutine in f"},
+			not:  []string{"deferred func in f", "subtest in TestF"},
+		},
+		{
+			args: []string{"-defers", "-tests"},
+			want: []string{"deferred func in f", "subtest in TestF"},
+			not:  []string{"goroutine in f"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			out := instrument(t, src, test.args...)
+
+			for _, want := range test.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("no log of the %s in\n%s", want, out)
+				}
+			}
+
+			for _, not := range test.not {
+				if strings.Contains(out, not) {
+					t.Errorf("a log of the %s in\n%s", not, out)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterFuncInfo(t *testing.T) {
+	src := `package p
+
+import "testing"
+
+func a() {
+}
+
+func b() {
+	go func() {}()
+	defer func() {}()
+}
+
+func TestC(t *testing.T) {
+	t.Run("sub", func(t *testing.T) {})
+}
+`
+
+	root, fset, err := GenerateAST("p.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allFuncInfo, err := GetAllFuncInfo(root, fset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := filepath.Abs("p.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[string]string)
+	for _, info := range allFuncInfo {
+		keys[DisplayName(info)] = FuncKey("p.go", info)
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "declared functions only",
+			want: []string{"a", "b", "TestC"},
+		},
+		{
+			name: "func literals",
+			opts: Options{Goroutines: true, Defers: true, Filter: FileFilter{Tests: true}},
+			want: []string{"a", "b", "goroutine in b", "deferred func in b", "TestC", "subtest in TestC"},
+		},
+		{
+			name: "changed lines",
+			opts: Options{Goroutines: true, Changes: ChangeSet{path: {{9, 9}}}},
+			want: []string{"b", "goroutine in b"},
+		},
+		{
+			name: "untracked file",
+			opts: Options{Changes: ChangeSet{path: nil}},
+			want: []string{"a", "b", "TestC"},
+		},
+		{
+			name: "other file changed",
+			opts: Options{Changes: ChangeSet{filepath.Join(filepath.Dir(path), "q.go"): nil}},
+		},
+		{
+			name: "picked functions",
+			opts: Options{Defers: true, Selected: map[string]bool{keys["a"]: true, keys["deferred func in b"]: true}},
+			want: []string{"a", "deferred func in b"},
+		},
+		{
+			name: "picked func literal of a disabled kind",
+			opts: Options{Selected: map[string]bool{keys["goroutine in b"]: true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, info := range FilterFuncInfo(allFuncInfo, "p.go", test.opts) {
+				got = append(got, DisplayName(info))
+			}
+
+			if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestInstrumentBuild instruments a module in place with flags that need the
+// runtime and checks the result builds, vets and logs
+func TestInstrumentBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the go command")
+	}
+
+	_, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+
+	dir := t.TempDir()
+
+	writeFiles(t, dir, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.22\n",
+		"main.go": `package main
+
+import (
+	"fmt"
+
+	"example.com/m/counter"
+)
+
+func main() {
+	var c counter.Counter
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Add(1)
+	}()
+	<-done
+
+	fmt.Println(c.Add(2))
+}
+`,
+		"counter/counter.go": `package counter
+
+import "errors"
+
+type Counter struct {
+	n int
+}
+
+func (c *Counter) Add(n int) (int, error) {
+	if n < 0 {
+		return c.n, errors.New("negative")
+	}
+
+	c.n += n
+	return c.n, nil
+}
+`,
+	})
+
+	err = RunCLI([]string{"instrument", "-config", "none", "-w", "-backup=false", "-time", "-call-id", "-goroutines", "-log-receiver", "-receiver-format", "exported", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, DepDir, RuntimeName))
+	if err != nil {
+		t.Fatalf("the runtime was not copied: %v", err)
+	}
+
+	_, err = runGo(dir, "vet", "./...")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runGo(dir, "run", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"Starting func main", "goroutine in main", "(*Counter).Add", "3 <nil>"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("no %q in the output of the instrumented program:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	DefaultEntryTemplate = "Starting {{.Func}}"
+	DefaultExitTemplate  = "Exiting {{.Func}} from line {{.Line}}"
+)
+
+// the fields available to -entry-template and -exit-template. The values
+// of parameters and results are not known until the log runs, they are
+// appended after the message.
+type MessageData struct {
+	Func    string // the function as the logs name it, e.g. func (*Server).Serve
+	Name    string // its bare name, e.g. Serve
+	Package string // name of its package
+	File    string // base name of its file
+	Line    int    // line of the func keyword on entry, of the exit point on exit
+	Params  string // names of its parameters, comma separated
+	Results string // names of its named results, comma separated
+}
+
+func GetMessageData(info FuncInfo, line int, opts Options) MessageData {
+	named, _ := GetNamedResults(info)
+
+	return MessageData{
+		Func:    LogLabel(info, opts),
+		Name:    info.Name,
+		Package: info.Package,
+		File:    filepath.Base(info.DeclPos.Filename),
+		Line:    line,
+		Params:  strings.Join(info.Params, ", "),
+		Results: strings.Join(named, ", "),
+	}
+}
+
+// ExpandMessage renders a message template, escaped to be used as the format
+// string of the log
+func ExpandMessage(name string, tmpl string, data MessageData) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid -%s: %w", name, err)
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("invalid -%s: %w", name, err)
+	}
+
+	return EscapeFormat(buf.String()), nil
+}
+
+// EscapeFormat makes s safe to put between the quotes of a format string
+func EscapeFormat(s string) string {
+	quoted := strconv.Quote(s)
+	return strings.ReplaceAll(quoted[1:len(quoted)-1], "%", "%%")
+}
+
+// the message a log starts with, tmpl is checked by CheckMessageTemplate
+// before anything is instrumented
+func GetMessage(name string, tmpl string, info FuncInfo, line int, opts Options) string {
+	msg, err := ExpandMessage(name, tmpl, GetMessageData(info, line, opts))
+	if err != nil {
+		return EscapeFormat(LogLabel(info, opts))
+	}
+
+	return msg
+}
+
+func CheckMessageTemplate(name string, tmpl string) error {
+	_, err := ExpandMessage(name, tmpl, MessageData{})
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const DefaultNameTemplate = "debug_{{.Name}}"
+
+// the fields available to -name-template
+type NameData struct {
+	Name string // file name, e.g. handler.go
+	Base string // file name without the extension, e.g. handler
+	Ext  string // extension including the dot, e.g. .go, _test.go for test files so copies stay tests
+}
+
+// name of the instrumented copy of the file name according to tmpl
+func ExpandName(tmpl string, name string) (string, error) {
+	if tmpl == "" {
+		tmpl = DefaultNameTemplate
+	}
+
+	t, err := template.New("name").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid -name-template: %w", err)
+	}
+
+	ext := filepath.Ext(name)
+	if strings.HasSuffix(name, "_test.go") {
+		ext = "_test.go"
+	}
+
+	data := NameData{Name: name, Base: strings.TrimSuffix(name, ext), Ext: ext}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("invalid -name-template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// make sure tmpl yields a usable, different go file name
+func CheckNameTemplate(tmpl string) error {
+	name, err := ExpandName(tmpl, "file.go")
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case name == "file.go":
+		return fmt.Errorf("invalid -name-template %q, it would overwrite the original file", tmpl)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("invalid -name-template %q, it must produce a file name, not a path", tmpl)
+	case !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go"):
+		return fmt.Errorf("invalid -name-template %q, the copy must end in .go (and not _test.go) to stay part of the package", tmpl)
+	}
+
+	return nil
+}
+
+// drop files that are the instrumented copies of other files in the list, so
+// copies written by an earlier run are never instrumented again
+func DropCopies(files []string, tmpl string) []string {
+	copies := make(map[string]bool)
+
+	for _, filePath := range files {
+		newPath, err := GetNewPath(filePath, tmpl)
+		if err == nil && newPath != filePath {
+			copies[newPath] = true
+		}
+	}
+
+	var kept []string
+	for _, filePath := range files {
+		if !copies[filePath] {
+			kept = append(kept, filePath)
+		}
+	}
+
+	return kept
+}
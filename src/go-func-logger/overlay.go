@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the file format go build -overlay reads
+type Overlay struct {
+	Replace map[string]string
+}
+
+// the instrumented copy of an absolute path inside the overlay directory
+func OverlayPath(dir string, filePath string) (string, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	rel := strings.TrimPrefix(absPath, filepath.VolumeName(absPath))
+	return filepath.Join(dir, rel), nil
+}
+
+// BuildOverlay instruments paths into a fresh temporary directory and maps
+// every original file to its instrumented copy. Files that failed or were
+// skipped are left out, their failures are returned next to the overlay.
+func BuildOverlay(paths []string, opts Options) (Overlay, string, error) {
+	overlay := Overlay{Replace: make(map[string]string)}
+
+	dir, err := os.MkdirTemp("", "gofunclogger-overlay-")
+	if err != nil {
+		return overlay, "", err
+	}
+
+	opts.OverlayDir = dir
+	opts.InPlace = false
+	opts.OutDir = ""
+
+	var targets []Target
+	var errs []error
+
+	stdFiles, err := StdlibFiles(opts.Std, opts.Filter, LogImportPaths(opts))
+	if err != nil {
+		return overlay, dir, err
+	}
+
+	paths = append(paths, stdFiles...)
+
+	for _, path := range paths {
+		pathTargets, err := ResolveTargets(path, opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		targets = append(targets, pathTargets...)
+	}
+
+	errs = append(errs, InstrumentTargets(targets, opts))
+
+	// the runtime only exists in the overlay as well, but its directory has
+	// to be there for go vet
+	if opts.RuntimeDir != "" {
+		names, err := WriteRuntime(filepath.Join(dir, RuntimeName), opts)
+		if err == nil {
+			err = os.MkdirAll(RuntimeVetDir(opts), 0o755)
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		for _, name := range names {
+			overlay.Replace[filepath.Join(opts.RuntimeDir, name)] = filepath.Join(dir, RuntimeName, name)
+		}
+	}
+
+	for _, target := range targets {
+		_, err := os.Stat(target.OutPath)
+		if err != nil {
+			continue
+		}
+
+		absPath, err := filepath.Abs(target.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		overlay.Replace[absPath] = target.OutPath
+	}
+
+	return overlay, dir, errors.Join(errs...)
+}
+
+func WriteOverlay(path string, overlay Overlay) error {
+	data, err := json.MarshalIndent(overlay, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing overlay: %w", err)
+	}
+
+	return nil
+}
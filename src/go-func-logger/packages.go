@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// a pattern is anything that is not an existing path on disk, or uses the ...
+// wildcard. Paths naming a .go file are never patterns, a mistyped file name
+// is reported as a missing file.
+func IsPackagePattern(path string) bool {
+	if strings.HasSuffix(path, ".go") {
+		return false
+	}
+
+	if strings.Contains(path, "...") {
+		return true
+	}
+
+	_, err := os.Stat(path)
+	return err != nil
+}
+
+// go/packages does the heavy lifting here, it understands modules, ./... style
+// wildcards and import paths and only reports the files that satisfy the
+// current build constraints
+func LoadPackages(mode packages.LoadMode, tests bool, patterns ...string) ([]*packages.Package, error) {
+	cfg := &packages.Config{Mode: mode, Tests: tests}
+
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, pkgErr := range pkg.Errors {
+			errs = append(errs, pkgErr)
+		}
+	})
+
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return pkgs, nil
+}
+
+// ListPackages loads the name, files and module of the packages matched by
+// patterns
+func ListPackages(patterns ...string) ([]*packages.Package, error) {
+	return LoadPackages(packages.NeedName|packages.NeedFiles|packages.NeedModule, false, patterns...)
+}
+
+// the standard library is the only place a package comes from without a module
+// and with no dot in the first element of its import path, the rule the go
+// command itself uses
+func IsStandard(pkg *packages.Package) bool {
+	first, _, _ := strings.Cut(pkg.PkgPath, "/")
+	return pkg.Module == nil && !strings.Contains(first, ".")
+}
+
+// package files are matched relative to the working directory
+func FindPackageFiles(pattern string, filter FileFilter) ([]string, error) {
+	var files []string
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs, err := LoadPackages(packages.NeedName|packages.NeedFiles, filter.Tests, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// with tests a package is listed once on its own and once more with its
+	// _test.go files, next to the generated test main
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if strings.HasSuffix(pkg.ID, ".test") {
+			continue
+		}
+
+		for _, path := range pkg.GoFiles {
+			if seen[path] || !IsInstrumentable(path) {
+				continue
+			}
+
+			seen[path] = true
+
+			rel, err := filepath.Rel(wd, path)
+			if err != nil {
+				rel = path
+			}
+
+			if !filter.MatchParents(rel) || !filter.MatchFile(path, rel) {
+				continue
+			}
+
+			files = append(files, path)
+		}
+	}
+
+	return files, nil
+}
+
+// the packages the patterns depend on, the packages matched by the patterns
+// included and every package after the ones it imports
+func PackageDeps(mode packages.LoadMode, patterns ...string) ([]*packages.Package, error) {
+	pkgs, err := LoadPackages(mode|packages.NeedName|packages.NeedImports|packages.NeedDeps, false, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	var deps []*packages.Package
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		deps = append(deps, pkg)
+	})
+
+	return deps, nil
+}
+
+// import paths of the packages from the main module that the patterns depend
+// on, the packages matched by the patterns included
+func MainModuleDeps(patterns ...string) ([]string, error) {
+	pkgs, err := PackageDeps(packages.NeedModule, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	var deps []string
+	for _, pkg := range pkgs {
+		if pkg.Module == nil || !pkg.Module.Main {
+			continue
+		}
+
+		deps = append(deps, pkg.PkgPath)
+	}
+
+	return deps, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strings"
+)
+
+// GetFieldTypes returns the type of every entry of a parameter or result
+// list, a field declaring several names counts once per name
+func GetFieldTypes(fields *ast.FieldList) []string {
+	var res []string
+
+	if fields == nil {
+		return res
+	}
+
+	for _, field := range fields.List {
+		typ := types.ExprString(field.Type)
+
+		res = append(res, typ)
+		for i := 1; i < len(field.Names); i++ {
+			res = append(res, typ)
+		}
+	}
+
+	return res
+}
+
+// the variables the return wrapper hands the returned values to
+func ResultVars(count int) []string {
+	var res []string
+
+	for i := 0; i < count; i++ {
+		res = append(res, fmt.Sprintf("result%d", i))
+	}
+
+	return res
+}
+
+// GetResultLog is GetParamLog for results: vars are the expressions holding
+// the values, labels what they are called in the log and types their types.
+// Unnamed and blank results are logged without a label.
+func GetResultLog(labels []string, vars []string, types []string, opts Options) (string, string, int) {
+	var log []string
+	var values []string
+
+	for i := range vars {
+		label := ""
+		if i < len(labels) {
+			label = labels[i]
+		}
+
+		verb, value := FormatValue(label, types[i], vars[i], opts)
+		values = append(values, value)
+
+		if label == "" || label == "_" {
+			log = append(log, verb)
+		} else {
+			log = append(log, label+": "+verb)
+		}
+	}
+
+	return strings.Join(log, ", "), strings.Join(values, ","), len(vars)
+}
+
+// the value -exit-errors checks before logging an exit, the last result if it
+// is an error. Empty if there is nothing to check, e.g. the error is a blank
+// named result handed back by a naked return.
+func ErrorResult(info FuncInfo, point ExitPoint) string {
+	last := len(info.ResultTypes) - 1
+	if last < 0 || info.ResultTypes[last] != "error" {
+		return ""
+	}
+
+	if point.ValuesPos.IsValid() {
+		return ResultVars(len(info.ResultTypes))[last]
+	}
+
+	if point.Naked && last < len(info.Returns) && info.Returns[last] != "" && info.Returns[last] != "_" {
+		return info.Returns[last]
+	}
+
+	return ""
+}
+
+// GetReturnWrapper turns `return a, b` into
+// `return func(result0 A, result1 B) (A, B) { log; return result0, result1 }(a, b)`
+// so the exit log sees the values after they were evaluated, without
+// evaluating them twice. It returns the func literal, InjectLogs calls it with
+// the values.
+func GetReturnWrapper(info FuncInfo, exitLog string) string {
+	vars := ResultVars(len(info.ResultTypes))
+
+	var params []string
+	for i, typ := range info.ResultTypes {
+		params = append(params, vars[i]+" "+typ)
+	}
+
+	results := strings.Join(info.ResultTypes, ", ")
+	if len(info.ResultTypes) > 1 {
+		results = "(" + results + ")"
+	}
+
+	return fmt.Sprintf("func(%s) %s { %s; return %s }", strings.Join(params, ", "), results, exitLog, strings.Join(vars, ", "))
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the runtime the injected logs call into when a plain fmt.Printf is not
+// enough, see funclog/funclog.go. Code that depends on the system lives in
+// files of its own with build constraints.
+//
+//go:embed funclog/*.go funclog/funcloghttp/*.go
+var runtimeFiles embed.FS
+
+// package name of the runtime and the directory below DepDir of the main
+// module it is copied to, so nothing has to be added to go.mod
+const RuntimeName = "funclog"
+
+// the HTTP handler of the runtime lives in a package of its own below it, so
+// only the programs that ask for it with -http-handler link net/http
+const HTTPHandlerName = "funcloghttp"
+
+// the import path of the runtime in this module, which the copy of the
+// handler imports under the import path of the copied runtime instead
+const RuntimeSourceImport = "github.com/himanshu808/go-func-logger/" + RuntimeName
+
+// NeedsRuntime reports whether the logs asked for by opts call into the
+// runtime
+func NeedsRuntime(opts Options) bool {
+	return opts.HTTPHandler || opts.LogReceiver && opts.ReceiverFormat == ReceiverExported || opts.Timestamps || opts.GoroutineID || opts.Durations || opts.Caller || opts.CallIDs || opts.CountCalls || opts.Indent || opts.MaxValueLen > 0 || opts.Deref || opts.ProcessInfo != "" || opts.Format == FormatJSON || opts.Format == FormatLogfmt || opts.Output != "" || opts.Color != "" || opts.Async > 0 || opts.Level != "" || opts.KillSwitch || opts.Signals || opts.Sample > 1 || len(opts.SampleFuncs) != 0 || opts.FuncToggles || opts.Ring > 0 || opts.RateLimit > 0
+}
+
+// LoadRuntime resolves where the runtime goes and under which import path the
+// injected logs find it, if they need it at all. It goes into the module of
+// the paths, which all have to be in the same one. Source read from stdin has
+// no module to put it in, nothing is written to disk for it.
+func LoadRuntime(opts *Options, paths []string) error {
+	if !NeedsRuntime(*opts) {
+		return nil
+	}
+
+	dir := ""
+	for _, path := range paths {
+		if path == "-" {
+			return &UsageError{Msg: "the funclog runtime the chosen options need cannot be used when reading the source from stdin"}
+		}
+
+		pathDir, err := ModuleDir(PathDir(path))
+		if err != nil {
+			return err
+		}
+
+		if dir != "" && pathDir != dir {
+			return fmt.Errorf("%s is not in the module at %s, the funclog runtime can only be added to one module", path, dir)
+		}
+
+		dir = pathDir
+	}
+
+	if dir == "" {
+		var err error
+		dir, err = MainModuleDir()
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := runGo(dir, "mod", "edit", "-json")
+	if err != nil {
+		return err
+	}
+
+	var gomod struct {
+		Module struct {
+			Path string
+		}
+	}
+
+	err = json.Unmarshal(out, &gomod)
+	if err != nil {
+		return err
+	}
+
+	opts.RuntimeDir = filepath.Join(dir, DepDir, RuntimeName)
+	opts.RuntimeImport = gomod.Module.Path + "/" + DepDir + "/" + RuntimeName
+	return nil
+}
+
+// WriteRuntime copies the runtime into dir and returns the names of its files
+// relative to dir. The HTTP handler is only copied with -http-handler.
+func WriteRuntime(dir string, opts Options) ([]string, error) {
+	names, err := writeRuntimeDir(RuntimeName, dir, "")
+	if err != nil || !opts.HTTPHandler {
+		return names, err
+	}
+
+	handlerNames, err := writeRuntimeDir(RuntimeName+"/"+HTTPHandlerName, filepath.Join(dir, HTTPHandlerName), opts.RuntimeImport)
+	for _, name := range handlerNames {
+		names = append(names, filepath.Join(HTTPHandlerName, name))
+	}
+
+	return names, err
+}
+
+// copies the files of the embedded directory src into dir, pointing their
+// imports of the runtime at runtimeImport if it is set
+func writeRuntimeDir(src string, dir string, runtimeImport string) ([]string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(runtimeFiles, src)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		data, err := runtimeFiles.ReadFile(src + "/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if runtimeImport != "" {
+			data = []byte(strings.ReplaceAll(string(data), strconv.Quote(RuntimeSourceImport), strconv.Quote(runtimeImport)))
+		}
+
+		err = os.WriteFile(filepath.Join(dir, entry.Name()), data, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, entry.Name())
+	}
+
+	return names, nil
+}
+
+// RuntimeVetDir is the deepest directory of the runtime, the one of the HTTP
+// handler if it is copied as well
+func RuntimeVetDir(opts Options) string {
+	if opts.HTTPHandler {
+		return filepath.Join(opts.RuntimeDir, HTTPHandlerName)
+	}
+
+	return opts.RuntimeDir
+}
+
+// MakeRuntimeDir creates the directory of the runtime, which the go command
+// wants to exist on disk to run vet in even if the file is only in an overlay.
+// The returned func removes the directories that had to be created again.
+func MakeRuntimeDir(dir string) (func(), error) {
+	var created []string
+	for d := dir; d != filepath.Dir(d); d = filepath.Dir(d) {
+		_, err := os.Stat(d)
+		if err == nil {
+			break
+		}
+
+		created = append(created, d)
+	}
+
+	cleanup := func() {
+		for _, d := range created {
+			os.Remove(d)
+		}
+	}
+
+	return cleanup, os.MkdirAll(dir, 0o755)
+}
+
+// the standard library packages the logs call besides the backend, imported
+// under their own name
+var StdLogImports = []LogImport{
+	{Name: "fmt", Path: "fmt"},
+	{Name: "debug", Path: "runtime/debug"}, // the stack of -recover
+}
+
+// AddLogImports imports the packages the logs call into that the file doesn't
+// import itself: fmt, runtime/debug, the runtime and the package of the
+// backend. They join the parenthesized import declaration of the file if it
+// has one, standard library packages the group of those and the others the
+// last group of third party imports, each where it sorts, or a group of their
+// own if the file has none of their kind. Otherwise they get an import declaration
+// of their own in front of the first declaration of the file, so a cgo
+// preamble stays with import "C". Without a Seq they go before any other log at their column.
+func AddLogImports(logs map[int][]LogInfo, root *ast.File, fset *token.FileSet, opts Options) {
+	var imports []LogImport
+	for _, imp := range StdLogImports {
+		if name, ok := opts.ImportNames[imp.Name]; ok {
+			imp.Name = name
+		}
+
+		imports = append(imports, imp)
+	}
+
+	if opts.RuntimeImport != "" {
+		imports = append(imports, LogImport{Name: RuntimeName, Path: opts.RuntimeImport})
+	}
+
+	if imp, ok := BackendImport(opts); ok {
+		imports = append(imports, imp)
+	}
+
+	var missing []LogImport
+	for _, imp := range imports {
+		if UsesPackage(logs, imp.Name) && !IsImported(root, imp) {
+			missing = append(missing, imp)
+		}
+	}
+
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Path < missing[j].Path })
+
+	if len(missing) == 0 {
+		return
+	}
+
+	block := ImportBlock(root)
+	if block == nil {
+		pos := fset.PositionFor(root.Decls[0].Pos(), false)
+
+		decl := "import " + ImportSpec(missing[0])
+		if len(missing) > 1 {
+			decl = "import (\n"
+			for _, imp := range missing {
+				decl += "\t" + ImportSpec(imp) + "\n"
+			}
+			decl += ")"
+		}
+
+		logs[pos.Line] = append([]LogInfo{{Log: decl, Col: pos.Column}}, logs[pos.Line]...)
+		return
+	}
+
+	for _, imp := range missing {
+		line, col, group := ImportPos(block, imp, fset)
+		logs[line] = append(logs[line], LogInfo{Log: ImportSpec(imp), Col: col, Group: group})
+	}
+}
+
+// LogImportNames picks the names the logs of the file call the StdLogImports
+// by where their own would not do: a local variable, parameter or other
+// package of the file named fmt hides the package. The name the file imports
+// the package under itself is used if it is free, a unique alias otherwise.
+func LogImportNames(root *ast.File) map[string]string {
+	names := make(map[string]string)
+
+	for _, imp := range StdLogImports {
+		var candidates []string
+		for _, spec := range root.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err == nil && path == imp.Path && spec.Name != nil && spec.Name.Name != "_" && spec.Name.Name != "." {
+				candidates = append(candidates, spec.Name.Name)
+			}
+		}
+
+		candidates = append(candidates, imp.Name, RuntimeName+imp.Name)
+
+		for _, name := range candidates {
+			if !NameTaken(root, name, imp.Path) {
+				if name != imp.Name {
+					names[imp.Name] = name
+				}
+				break
+			}
+		}
+	}
+
+	return names
+}
+
+// NameTaken reports whether name means something else than the package of
+// path somewhere in the file: another import by that name or an identifier
+// that is not the package of a selector. Identifiers declared in other files
+// of the package are not seen.
+func NameTaken(root *ast.File, name string, path string) bool {
+	for _, spec := range root.Imports {
+		specPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+
+		specName := pathpkg.Base(specPath)
+		if spec.Name != nil {
+			specName = spec.Name.Name
+		}
+
+		if specName == name && specPath != path {
+			return true
+		}
+	}
+
+	taken := false
+	ast.Inspect(root, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ImportSpec:
+			return false
+		case *ast.SelectorExpr:
+			// the package of a selector is fine, the selected name is never
+			// the package
+			if _, ok := n.X.(*ast.Ident); ok {
+				return false
+			}
+
+			ast.Inspect(n.X, func(x ast.Node) bool {
+				ident, ok := x.(*ast.Ident)
+				taken = taken || ok && ident.Name == name
+				return !taken
+			})
+
+			return false
+		case *ast.Ident:
+			taken = taken || n != root.Name && n.Name == name
+		}
+
+		return !taken
+	})
+
+	return taken
+}
+
+// RenameImports calls the packages in log by the names the file has for
+// them, leaving string literals alone
+func RenameImports(log string, names map[string]string) string {
+	for name, alias := range names {
+		pattern := regexp.MustCompile(`(^|[^\w.])` + regexp.QuoteMeta(name) + `\.`)
+
+		var b strings.Builder
+		prev := 0
+		for _, loc := range stringPattern.FindAllStringIndex(log, -1) {
+			b.WriteString(pattern.ReplaceAllString(log[prev:loc[0]], "${1}"+alias+"."))
+			b.WriteString(log[loc[0]:loc[1]])
+			prev = loc[1]
+		}
+
+		b.WriteString(pattern.ReplaceAllString(log[prev:], "${1}"+alias+"."))
+		log = b.String()
+	}
+
+	return log
+}
+
+// IsImported reports whether the file imports the package of imp under the
+// name the logs call it by
+func IsImported(root *ast.File, imp LogImport) bool {
+	for _, spec := range root.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || path != imp.Path {
+			continue
+		}
+
+		name := pathpkg.Base(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+
+		if name == imp.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ImportBlock is the first parenthesized import declaration of the file, nil
+// if it has none
+func ImportBlock(root *ast.File) *ast.GenDecl {
+	for _, decl := range root.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if ok && gen.Tok == token.IMPORT && gen.Lparen.IsValid() && len(gen.Specs) != 0 {
+			return gen
+		}
+	}
+
+	return nil
+}
+
+// the import spec of imp, standard library packages without their name
+func ImportSpec(imp LogImport) string {
+	if IsStdImport(imp.Path) && imp.Name == pathpkg.Base(imp.Path) {
+		return strconv.Quote(imp.Path)
+	}
+
+	return fmt.Sprintf("%s %q", imp.Name, imp.Path)
+}
+
+// standard library import paths have no dot in their first element
+func IsStdImport(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return !strings.Contains(first, ".")
+}
+
+// ImportPos is where the spec of imp goes in block: in front of the first
+// spec of its group it sorts before, or after the last one. Groups are
+// separated by blank lines. Without a group of its kind, it starts one of its
+// own in front of the first group for the standard library, after the last
+// one for everything else, and group is true.
+func ImportPos(block *ast.GenDecl, imp LogImport, fset *token.FileSet) (line int, col int, group bool) {
+	var groups [][]*ast.ImportSpec
+	prevLine := 0
+
+	for _, s := range block.Specs {
+		spec := s.(*ast.ImportSpec)
+		line := fset.PositionFor(spec.Pos(), false).Line
+
+		if len(groups) == 0 || line > prevLine+1 {
+			groups = append(groups, nil)
+		}
+
+		groups[len(groups)-1] = append(groups[len(groups)-1], spec)
+		prevLine = fset.PositionFor(spec.End(), false).Line
+	}
+
+	std := IsStdImport(imp.Path)
+
+	// the first group of its kind for the standard library, the last for
+	// everything else
+	var specs []*ast.ImportSpec
+	for i := range groups {
+		if !std {
+			i = len(groups) - 1 - i
+		}
+
+		path, _ := strconv.Unquote(groups[i][0].Path.Value)
+		if IsStdImport(path) == std {
+			specs = groups[i]
+			break
+		}
+	}
+
+	if specs == nil {
+		if std {
+			pos := fset.PositionFor(block.Specs[0].Pos(), false)
+			return pos.Line, pos.Column, true
+		}
+
+		end := fset.PositionFor(block.Specs[len(block.Specs)-1].End(), false)
+		return end.Line, end.Column, true
+	}
+
+	for _, spec := range specs {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		if path > imp.Path {
+			pos := fset.PositionFor(spec.Pos(), false)
+			return pos.Line, pos.Column, false
+		}
+	}
+
+	end := fset.PositionFor(specs[len(specs)-1].End(), false)
+	return end.Line, end.Column, false
+}
+
+// string literals in the logs, which may quote the source of the function
+var stringPattern = regexp.MustCompile(`"(\\.|[^"\\])*"|` + "`[^`]*`")
+
+// reports whether any of the logs refers to the package imported as name
+func UsesPackage(logs map[int][]LogInfo, name string) bool {
+	pattern := regexp.MustCompile(`(^|[^\w.])` + regexp.QuoteMeta(name) + `\.`)
+
+	for _, infos := range logs {
+		for _, info := range infos {
+			if pattern.MatchString(stringPattern.ReplaceAllString(info.Log, `""`)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// SampleRate is a -sample-func flag, log 1 in Every calls of the functions
+// whose name matches Pattern
+type SampleRate struct {
+	Pattern string
+	Every   int
+}
+
+// repeatable NAME=N flag, e.g. -sample-func Parse=100 -sample-func 'store.*=10'
+type SampleRates []SampleRate
+
+func (l *SampleRates) String() string {
+	var rates []string
+	for _, rate := range *l {
+		rates = append(rates, fmt.Sprintf("%s=%d", rate.Pattern, rate.Every))
+	}
+
+	return strings.Join(rates, ",")
+}
+
+func (l *SampleRates) Set(value string) error {
+	pattern, every, ok := strings.Cut(value, "=")
+	if !ok || pattern == "" {
+		return fmt.Errorf("%q is not NAME=N", value)
+	}
+
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.Atoi(every)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q is not a number of calls", every)
+	}
+
+	*l = append(*l, SampleRate{Pattern: pattern, Every: n})
+	return nil
+}
+
+// GetSampleRate is how many calls of the function share one with logs: the
+// last -sample-func matching its name with or without the package, -sample
+// otherwise. 0 and 1 log every call.
+func GetSampleRate(info FuncInfo, opts Options) int {
+	every := opts.Sample
+
+	for _, rate := range opts.SampleFuncs {
+		for _, name := range []string{QualifiedName(info, Options{}), QualifiedName(info, Options{Qualified: true})} {
+			ok, _ := path.Match(rate.Pattern, name)
+			if ok {
+				every = rate.Every
+				break
+			}
+		}
+	}
+
+	return every
+}
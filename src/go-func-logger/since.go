@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type LineRange struct {
+	Start int
+	End   int // inclusive
+}
+
+// ChangeSet maps absolute file paths to the lines that changed in them, a
+// file mapped to nil changed as a whole (e.g. it is untracked)
+type ChangeSet map[string][]LineRange
+
+var hunkRegexp = regexp.MustCompile(`^@@ -\d+(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// ParseDiff collects the added and removed lines of a unified diff as line
+// numbers of the new side, file names are resolved relative to base. Context
+// lines are skipped, so diffs with any amount of context work.
+func ParseDiff(r io.Reader, base string) (ChangeSet, error) {
+	changes := make(ChangeSet)
+
+	var current string
+	// line number on the new side and the lines left in the current hunk
+	newLine, oldLeft, newLeft := 0, 0, 0
+
+	lines, err := ReadLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		if oldLeft > 0 || newLeft > 0 {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				changes[current] = append(changes[current], LineRange{Start: newLine, End: newLine})
+				newLine++
+				newLeft--
+			case strings.HasPrefix(line, "-"):
+				// a removed line is attributed to the line that now takes its place
+				changes[current] = append(changes[current], LineRange{Start: newLine, End: newLine})
+				oldLeft--
+			case strings.HasPrefix(line, " ") || line == "":
+				newLine++
+				oldLeft--
+				newLeft--
+			case strings.HasPrefix(line, "\\"):
+				// \ No newline at end of file
+			default:
+				oldLeft, newLeft = 0, 0
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(line, "+++ ") {
+			name := strings.TrimPrefix(line, "+++ ")
+			if idx := strings.IndexByte(name, '\t'); idx != -1 {
+				name = name[:idx]
+			}
+
+			current = ""
+			if name == "/dev/null" {
+				continue
+			}
+
+			current = filepath.Join(base, filepath.FromSlash(strings.TrimPrefix(name, "b/")))
+			if _, ok := changes[current]; !ok {
+				changes[current] = []LineRange{}
+			}
+
+			continue
+		}
+
+		match := hunkRegexp.FindStringSubmatch(line)
+		if match == nil || current == "" {
+			continue
+		}
+
+		oldLeft, newLeft = 1, 1
+		if match[1] != "" {
+			oldLeft, _ = strconv.Atoi(match[1])
+		}
+
+		newLine, _ = strconv.Atoi(match[2])
+		if match[3] != "" {
+			newLeft, _ = strconv.Atoi(match[3])
+		}
+
+		// a hunk that only removes lines names the line before the removal
+		if newLeft == 0 {
+			newLine++
+		}
+	}
+
+	return changes, nil
+}
+
+func runGit(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	return out, nil
+}
+
+func GitTopLevel() (string, error) {
+	out, err := runGit("rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// LoadChanges diffs the working tree against ref, or reads a unified diff from
+// stdin when ref is -. Untracked files count as changed entirely.
+func LoadChanges(ref string) (ChangeSet, error) {
+	top, err := GitTopLevel()
+	if ref == "-" {
+		// a diff piped in from elsewhere does not need a repository
+		if err != nil {
+			top, err = os.Getwd()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return ParseDiff(os.Stdin, top)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := runGit("-C", top, "diff", "-U0", "--no-color", "--no-ext-diff", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := ParseDiff(bytes.NewReader(out), top)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = runGit("-C", top, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if name != "" {
+			changes[filepath.Join(top, filepath.FromSlash(name))] = nil
+		}
+	}
+
+	return changes, nil
+}
+
+// the file is either not part of the change set at all or did not change
+func (c ChangeSet) FileChanged(filePath string) bool {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return false
+	}
+
+	ranges, ok := c[path]
+	return ok && (ranges == nil || len(ranges) != 0)
+}
+
+// Touches reports whether any changed line of filePath falls into [start, end]
+func (c ChangeSet) Touches(filePath string, start int, end int) bool {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return false
+	}
+
+	ranges, ok := c[path]
+	if !ok {
+		return false
+	}
+
+	if ranges == nil {
+		return true
+	}
+
+	for _, r := range ranges {
+		if r.Start <= end && start <= r.End {
+			return true
+		}
+	}
+
+	return false
+}
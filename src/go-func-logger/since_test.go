@@ -0,0 +1,146 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want map[string][]LineRange
+	}{
+		{
+			name: "added and removed lines with context",
+			diff: `diff --git a/x.go b/x.go
+--- a/x.go
++++ b/x.go
+@@ -3,3 +3,4 @@ func f() {
+ 	a()
+-	b()
++	c()
++	d()
+ 	e()
+`,
+			want: map[string][]LineRange{"x.go": {{4, 4}, {4, 4}, {5, 5}}},
+		},
+		{
+			name: "several hunks without context",
+			diff: `--- a/x.go
++++ b/x.go
+@@ -2 +2 @@
+-a
++b
+@@ -10,0 +11,2 @@
++c
++d
+`,
+			want: map[string][]LineRange{"x.go": {{2, 2}, {2, 2}, {11, 11}, {12, 12}}},
+		},
+		{
+			name: "only removed lines",
+			diff: `--- a/x.go
++++ b/x.go
+@@ -5,2 +4,0 @@
+-a
+-b
+`,
+			want: map[string][]LineRange{"x.go": {{5, 5}, {5, 5}}},
+		},
+		{
+			name: "new and deleted files",
+			diff: `--- /dev/null
++++ b/dir/new.go	2024-01-02 03:04:05
+@@ -0,0 +1,2 @@
++package dir
++
+--- a/gone.go
++++ /dev/null
+@@ -1 +0,0 @@
+-package gone
+`,
+			want: map[string][]LineRange{"dir/new.go": {{1, 1}, {2, 2}}},
+		},
+		{
+			name: "renamed without changes",
+			diff: `diff --git a/old.go b/new.go
+similarity index 100%
+rename from old.go
+rename to new.go
+--- a/old.go
++++ b/new.go
+`,
+			want: map[string][]LineRange{"new.go": {}},
+		},
+		{
+			name: "no newline at end of file",
+			diff: `--- a/x.go
++++ b/x.go
+@@ -1 +1 @@
+-}
+\ No newline at end of file
++}
+`,
+			want: map[string][]LineRange{"x.go": {{1, 1}, {1, 1}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := t.TempDir()
+
+			got, err := ParseDiff(strings.NewReader(test.diff), base)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(ChangeSet)
+			for name, ranges := range test.want {
+				want[filepath.Join(base, filepath.FromSlash(name))] = ranges
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestChangeSetTouches(t *testing.T) {
+	base := t.TempDir()
+	changed, renamed, untracked := filepath.Join(base, "x.go"), filepath.Join(base, "y.go"), filepath.Join(base, "z.go")
+
+	changes := ChangeSet{
+		changed:   {{4, 4}, {10, 12}},
+		renamed:   {},
+		untracked: nil,
+	}
+
+	tests := []struct {
+		path       string
+		start, end int
+		want       bool
+	}{
+		{changed, 1, 3, false},
+		{changed, 1, 4, true},
+		{changed, 5, 9, false},
+		{changed, 12, 20, true},
+		{renamed, 1, 100, false},
+		{untracked, 1, 1, true},
+		{filepath.Join(base, "other.go"), 1, 100, false},
+	}
+
+	for _, test := range tests {
+		got := changes.Touches(test.path, test.start, test.end)
+		if got != test.want {
+			t.Errorf("Touches(%s, %d, %d) = %v, want %v", filepath.Base(test.path), test.start, test.end, got, test.want)
+		}
+	}
+
+	if !changes.FileChanged(changed) || changes.FileChanged(renamed) || !changes.FileChanged(untracked) {
+		t.Errorf("FileChanged does not match the ranges of %v", changes)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+)
+
+// StdlibFiles lists the files of the given standard library packages. They are
+// only ever instrumented into an overlay, GOROOT itself is never written to.
+// The injected logs call fmt and the package of the backend, logImports, so
+// these and everything they import are refused, instrumenting them would
+// create an import cycle.
+func StdlibFiles(importPaths []string, filter FileFilter, logImports []string) ([]string, error) {
+	if len(importPaths) == 0 {
+		return nil, nil
+	}
+
+	logDeps, err := PackageDeps(0, logImports...)
+	if err != nil {
+		return nil, err
+	}
+
+	forbidden := make(map[string]bool)
+	for _, pkg := range logDeps {
+		forbidden[pkg.PkgPath] = true
+	}
+
+	var files []string
+	for _, importPath := range importPaths {
+		pkgs, err := ListPackages(importPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pkg := range pkgs {
+			if !IsStandard(pkg) {
+				return nil, fmt.Errorf("-std %s: %s is not part of the standard library", importPath, pkg.PkgPath)
+			}
+
+			if forbidden[pkg.PkgPath] {
+				return nil, fmt.Errorf("-std %s: the injected logs depend on %s, they cannot be used in it", importPath, pkg.PkgPath)
+			}
+		}
+
+		pkgFiles, err := FindPackageFiles(importPath, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, pkgFiles...)
+	}
+
+	return files, nil
+}
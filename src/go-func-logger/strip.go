@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// appended to every injected line so strip and the idempotency check can
+// find them reliably and reviewers can tell them apart from hand written code
+const InjectedMarker = "// gofunclogger:auto"
+
+// code injected into the middle of an existing line, like the wrapper that
+// captures the values of a return statement, is enclosed in these
+const (
+	InlineStart = "/*gofunclogger:auto{*/"
+	InlineEnd   = "/*}*/"
+)
+
+// follows the names -name-params gives unnamed parameters, the comma in front
+// of a name stays outside of it
+const InjectedName = "/*gofunclogger:auto*/"
+
+// gofmt may break the code between them over several lines
+var inlinePattern = regexp.MustCompile(`(?s)` + regexp.QuoteMeta(InlineStart) + `.*?` + regexp.QuoteMeta(InlineEnd))
+
+// IsInjectedLine reports whether line carries a marker. Hand written code
+// looking like a log, without one, is never taken for injected code.
+func IsInjectedLine(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasSuffix(line, InjectedMarker) || inlinePattern.MatchString(line)
+}
+
+// IsInstrumented reports whether contents hold injected code. The markers of
+// a file that parses only count as comments, not quoted in a string.
+func IsInstrumented(contents []string) bool {
+	_, count, err := StripSource([]byte(JoinLines(contents)))
+	if err != nil {
+		return HasInjectedLines(contents)
+	}
+
+	return count != 0
+}
+
+func HasInjectedLines(contents []string) bool {
+	for _, line := range contents {
+		if IsInjectedLine(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StripContents removes the injected code from the lines of a file with
+// StripSource, or StripLines if they don't parse, and reports how many lines
+// were removed or changed
+func StripContents(contents []string) ([]string, int) {
+	src, count, err := StripSource([]byte(JoinLines(contents)))
+	if err != nil {
+		return StripLines(contents)
+	}
+
+	if count == 0 {
+		return contents, 0
+	}
+
+	stripped, err := ReadLines(bytes.NewReader(src))
+	if err != nil {
+		return StripLines(contents)
+	}
+
+	return stripped, count
+}
+
+// StripSource removes the injected code from src and reports how many lines
+// were removed or changed. The code is found in the syntax tree by the
+// comments marking it, so markers quoted in a string literal are left alone:
+// the statements, declarations and specs followed by the InjectedMarker on
+// the line they end on go with their lines, the func literal wrapping the
+// values of a return statement and the names following InjectedName are cut
+// out of theirs. The //line directives following a line with nothing but the
+// InjectedMarker go with it, the ones of the original stay.
+func StripSource(src []byte) ([]byte, int, error) {
+	fset := token.NewFileSet()
+
+	root, err := parser.ParseFile(fset, "", src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s := &stripper{
+		src:     src,
+		file:    fset.File(root.Pos()),
+		markers: make(map[int]*ast.Comment),
+		done:    make(map[*ast.Comment]bool),
+	}
+
+	for _, group := range root.Comments {
+		for _, comment := range group.List {
+			s.comments = append(s.comments, comment)
+			if comment.Text == InjectedMarker {
+				s.markers[s.lineOf(comment.Pos())] = comment
+			}
+		}
+	}
+
+	ast.Inspect(root, s.visit)
+	s.cutInline()
+
+	for _, comment := range s.comments {
+		if !lineDirectivePattern.MatchString(comment.Text) || !s.startsLine(comment.Pos()) {
+			continue
+		}
+
+		marker, ok := s.markers[s.lineOf(comment.Pos())-1]
+		if ok && s.startsLine(marker.Pos()) {
+			s.cutLines(marker.Pos(), comment.End())
+		}
+	}
+
+	if len(s.cuts) == 0 {
+		return src, 0, nil
+	}
+
+	return s.apply()
+}
+
+// stripper collects the parts of a file StripSource cuts out
+type stripper struct {
+	src      []byte
+	file     *token.File
+	comments []*ast.Comment
+	markers  map[int]*ast.Comment // the InjectedMarker on a line
+	done     map[*ast.Comment]bool
+	cuts     [][2]int // the offsets cut out, from and to
+}
+
+func (s *stripper) visit(n ast.Node) bool {
+	switch n := n.(type) {
+	case nil:
+		return false
+	case *ast.CaseClause, *ast.CommClause:
+		// they end with their last statement, which is never injected
+		return true
+	case *ast.ReturnStmt:
+		s.cutWrapper(n)
+	case *ast.Field:
+		s.cutName(n)
+	}
+
+	switch n.(type) {
+	case ast.Stmt, ast.Decl, ast.Spec:
+		marker, ok := s.markers[s.lineOf(n.End())]
+		if ok && marker.Pos() >= n.End() {
+			s.done[marker] = true
+			s.cutLines(n.Pos(), marker.End())
+			return false
+		}
+	}
+
+	return true
+}
+
+// cutWrapper cuts the func literal wrapping the values of ret out, see
+// GetReturnWrapper. The /*line*/ directive in front of the values goes with it.
+func (s *stripper) cutWrapper(ret *ast.ReturnStmt) {
+	if len(ret.Results) != 1 {
+		return
+	}
+
+	call, ok := ret.Results[0].(*ast.CallExpr)
+	if !ok || len(call.Args) == 0 || call.Ellipsis.IsValid() {
+		return
+	}
+
+	if _, ok := call.Fun.(*ast.FuncLit); !ok {
+		return
+	}
+
+	first, last := call.Args[0], call.Args[len(call.Args)-1]
+
+	open := s.comment(InlineStart, ret.Pos(), call.Pos())
+	lparen := s.comment(InlineEnd, call.Lparen, first.Pos())
+	rparen := s.comment(InlineStart, last.End(), call.Rparen)
+	end := s.comment(InlineEnd, call.Rparen, token.Pos(s.file.Base()+s.file.Size()))
+	if open == nil || lparen == nil || rparen == nil || end == nil {
+		return
+	}
+
+	s.done[open], s.done[lparen], s.done[rparen], s.done[end] = true, true, true, true
+	s.cut(open.Pos(), first.Pos())
+	s.cut(last.End(), end.End())
+}
+
+// cutName cuts the name -name-params gave the parameter field out
+func (s *stripper) cutName(field *ast.Field) {
+	if len(field.Names) != 1 {
+		return
+	}
+
+	marker := s.comment(InjectedName, field.Names[0].End(), field.Type.Pos())
+	if marker == nil {
+		return
+	}
+
+	s.done[marker] = true
+	s.cut(field.Names[0].Pos(), field.Type.Pos())
+}
+
+// cutInline cuts out what is left between an InlineStart and InlineEnd, like
+// the parameter names of older versions
+func (s *stripper) cutInline() {
+	var start *ast.Comment
+	for _, comment := range s.comments {
+		if s.done[comment] {
+			continue
+		}
+
+		switch comment.Text {
+		case InlineStart:
+			start = comment
+		case InlineEnd:
+			if start != nil {
+				s.cut(start.Pos(), comment.End())
+				start = nil
+			}
+		}
+	}
+}
+
+// the first comment with text from the position from on before to
+func (s *stripper) comment(text string, from, to token.Pos) *ast.Comment {
+	for _, comment := range s.comments {
+		if comment.Pos() >= from && comment.Pos() < to && comment.Text == text {
+			return comment
+		}
+	}
+
+	return nil
+}
+
+func (s *stripper) cut(from, to token.Pos) {
+	s.cuts = append(s.cuts, [2]int{s.file.Offset(from), s.file.Offset(to)})
+}
+
+// cutLines cuts the lines from is on through the one to is on
+func (s *stripper) cutLines(from, to token.Pos) {
+	start := s.file.Offset(s.file.LineStart(s.lineOf(from)))
+
+	end := len(s.src)
+	if line := s.lineOf(to); line < s.file.LineCount() {
+		end = s.file.Offset(s.file.LineStart(line + 1))
+	}
+
+	s.cuts = append(s.cuts, [2]int{start, end})
+}
+
+// the line pos is on in src, //line directives don't count
+func (s *stripper) lineOf(pos token.Pos) int {
+	return s.file.PositionFor(pos, false).Line
+}
+
+// the text of the line pos is on
+func (s *stripper) line(pos token.Pos) string {
+	start := s.file.Offset(s.file.LineStart(s.lineOf(pos)))
+
+	end := bytes.IndexByte(s.src[start:], '\n')
+	if end < 0 {
+		return string(s.src[start:])
+	}
+
+	return string(s.src[start : start+end])
+}
+
+// startsLine reports whether there is nothing but indentation in front of pos
+func (s *stripper) startsLine(pos token.Pos) bool {
+	col := s.file.PositionFor(pos, false).Column
+	return strings.TrimLeft(s.line(pos)[:col-1], " \t") == ""
+}
+
+// apply cuts the parts out of src, and counts the lines they were on
+func (s *stripper) apply() ([]byte, int, error) {
+	sort.Slice(s.cuts, func(i, j int) bool { return s.cuts[i][0] < s.cuts[j][0] })
+
+	lines := make(map[int]bool)
+	var b bytes.Buffer
+	prev := 0
+	for _, cut := range s.cuts {
+		if cut[1] <= prev {
+			continue
+		}
+
+		from := cut[0]
+		if from < prev {
+			from = prev
+		}
+
+		b.Write(s.src[prev:from])
+		prev = cut[1]
+
+		for line := s.lineOf(s.file.Pos(from)); line <= s.lineOf(s.file.Pos(cut[1]-1)); line++ {
+			lines[line] = true
+		}
+	}
+	b.Write(s.src[prev:])
+
+	return b.Bytes(), len(lines), nil
+}
+
+// StripLines drops every injected log line, cuts the inline injections out of
+// the others and reports how many lines were removed or changed. It is how
+// files that don't parse are stripped.
+func StripLines(contents []string) ([]string, int) {
+	var stripped []string
+	count := 0
+
+	// the markers quoted in a string, like in this file, are left alone
+	joined := strings.Join(contents, "\n")
+	var b strings.Builder
+	prev := 0
+	for _, loc := range inlinePattern.FindAllStringIndex(joined, -1) {
+		if loc[0] > 0 && joined[loc[0]-1] == '"' {
+			continue
+		}
+
+		b.WriteString(joined[prev:loc[0]])
+		prev = loc[1]
+		count = count + 1
+	}
+
+	if count != 0 {
+		b.WriteString(joined[prev:])
+		contents = strings.Split(b.String(), "\n")
+	}
+
+	for i, line := range contents {
+		if lineDirectivePattern.MatchString(line) && i > 0 && strings.TrimSpace(contents[i-1]) == InjectedMarker {
+			count = count + 1
+			continue
+		}
+
+		if IsInjectedLine(line) {
+			count = count + 1
+
+			// only the last line of a statement gofmt broke up carries the
+			// marker, the lines before it open what it closes
+			for depth := BracketDepth(line); depth < 0 && len(stripped) != 0; count = count + 1 {
+				depth += BracketDepth(stripped[len(stripped)-1])
+				stripped = stripped[:len(stripped)-1]
+			}
+
+			continue
+		}
+
+		stripped = append(stripped, line)
+	}
+
+	return stripped, count
+}
+
+// BracketDepth is how many more brackets line opens than it closes, leaving
+// out string and rune literals and comments
+func BracketDepth(line string) int {
+	depth := 0
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case '(', '[', '{':
+			depth = depth + 1
+		case ')', ']', '}':
+			depth = depth - 1
+		case '"', '\'', '`':
+			for i = i + 1; i < len(line) && line[i] != c; i++ {
+				if line[i] == '\\' && c != '`' {
+					i = i + 1
+				}
+			}
+		case '/':
+			if strings.HasPrefix(line[i:], "//") {
+				return depth
+			}
+
+			if strings.HasPrefix(line[i:], "/*") {
+				end := strings.Index(line[i+2:], "*/")
+				if end < 0 {
+					return depth
+				}
+
+				i = i + 2 + end + 1
+			}
+		}
+	}
+
+	return depth
+}
+
+// FormatStripped formats what is left of a file formatted with the logs in it,
+// which takes out the spaces gofmt put around the inline injections and lines
+// up the comments that were lined up with the markers again. Sources that don't
+// parse are left as they are.
+func FormatStripped(name string, stripped []string, indent string) []string {
+	src, err := FormatSource(name, []byte(JoinLines(stripped)), indent)
+	if err != nil {
+		return stripped
+	}
+
+	lines, err := ReadLines(bytes.NewReader(src))
+	if err != nil {
+		return stripped
+	}
+
+	return lines
+}
+
+func StripFile(filePath string, newFilePath string, opts Options, out *Output) error {
+	src, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	opts.LineStyle = GetLineStyle(src)
+
+	contents, err := ReadLines(bytes.NewReader(TrimBOM(src)))
+	if err != nil {
+		return err
+	}
+
+	stripped, count := StripContents(contents)
+	if count == 0 && newFilePath == filePath {
+		return nil
+	}
+
+	stripped = FormatStripped(filePath, stripped, opts.LineStyle.Indent)
+
+	if opts.DryRun {
+		fmt.Fprint(&out.Stdout, UnifiedDiff(filePath, newFilePath, contents, stripped))
+		return nil
+	}
+
+	if newFilePath == filePath && opts.Backup {
+		err = WriteBackup(filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(newFilePath), 0o755)
+	if err != nil {
+		return err
+	}
+
+	err = WriteLinesToFile(newFilePath, filePath, stripped, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(&out.Stderr, "removed %d injected line(s) from %s\n", count, filePath)
+	return nil
+}
+
+func StripStdin(opts Options) error {
+	src, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	contents, err := ReadLines(bytes.NewReader(TrimBOM(src)))
+	if err != nil {
+		return err
+	}
+
+	stripped, count := StripContents(contents)
+	if count != 0 {
+		stripped = FormatStripped("<standard input>", stripped, GetLineStyle(src).Indent)
+	}
+
+	if opts.DryRun {
+		fmt.Print(UnifiedDiff("<standard input>", "<standard output>", contents, stripped))
+		return nil
+	}
+
+	_, err = os.Stdout.Write(GetLineStyle(src).Apply([]byte(JoinLines(stripped))))
+	return err
+}
+
+// without -outdir the files are restored in place
+func StripPath(path string, opts Options) error {
+	if path == "-" {
+		return StripStdin(opts)
+	}
+
+	opts.InPlace = opts.OutDir == ""
+
+	targets, err := ResolveTargets(path, opts)
+	if err != nil {
+		return err
+	}
+
+	return ProcessTargets(targets, opts.Jobs, func(target Target, out *Output) error {
+		return StripFile(target.Path, target.OutPath, opts, out)
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		args []string
+	}{
+		{
+			name: "unnamed parameters",
+			src: `package p
+
+func unnamed(int, string) {
+	println()
+}
+
+func variadic(a int, _ bool) func(int, ...string) {
+	return func(int, ...string) {
+		println(a)
+	}
+}
+`,
+			args: []string{"-name-params"},
+		},
+		{
+			name: "return wrappers",
+			src: `package p
+
+import "errors"
+
+func div(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+
+	return a / b, nil
+}
+
+func long(xs []int) []int {
+	return append(xs,
+		1,
+		2,
+	)
+}
+`,
+		},
+		{
+			name: "raw strings",
+			src: "package p\n\n" +
+				"const marker = `return /*gofunclogger:auto{*/ x /*}*/\n" +
+				"fmt.Println(\"Starting func f\") // gofunclogger:auto\n" +
+				"`\n\n" +
+				"func f() string {\n" +
+				"\treturn `/*gofunclogger:auto{*/` + marker + `/*}*/`\n" +
+				"}\n",
+		},
+		{
+			name: "comments and labels",
+			src: `package p
+
+// f counts
+func f(n int) int {
+	x := 0 // the count
+loop:
+	for i := 0; i < n; i++ {
+		if i > 10 {
+			break loop
+		}
+		x++ // one more
+	}
+	return x
+}
+`,
+		},
+		{
+			name: "imports without a block",
+			src: `package p
+
+import "os"
+
+func f() {
+	os.Exit(1)
+}
+`,
+			args: []string{"-recover"},
+		},
+		{
+			name: "import groups",
+			src: `package p
+
+import (
+	"os"
+
+	"example.com/a"
+)
+
+func f() {
+	a.F(os.Args)
+}
+
+func g() error {
+	return nil
+}
+`,
+			args: []string{"-backend", "zap", "-recover"},
+		},
+		{
+			name: "third party group of its own",
+			src: `package p
+
+import (
+	"os"
+)
+
+func f() {
+	os.Exit(1)
+}
+`,
+			args: []string{"-backend", "zap"},
+		},
+		{
+			name: "recover and panics",
+			src: `package p
+
+import (
+	"errors"
+	"os"
+)
+
+func f() {
+	if len(os.Args) == 0 {
+		panic(errors.New("no args"))
+	}
+	os.Exit(1)
+}
+`,
+			args: []string{"-recover"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := instrument(t, test.src, test.args...)
+
+			contents, err := ReadLines(strings.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stripped, count := StripContents(contents)
+			if count == 0 {
+				t.Fatalf("nothing was stripped from\n%s", out)
+			}
+
+			got := JoinLines(FormatStripped("test.go", stripped, "\t"))
+			if got != test.src {
+				t.Errorf("stripping\n%s\ngave\n%s\nwant\n%s", out, got, test.src)
+			}
+		})
+	}
+}
+
+func TestStripQuotedMarkers(t *testing.T) {
+	src := "package p\n\n" +
+		"const s = `a /*gofunclogger:auto{*/ b /*}*/ c\n" +
+		"x() // gofunclogger:auto\n" +
+		"`\n"
+
+	contents, err := ReadLines(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IsInstrumented(contents) {
+		t.Errorf("markers in a raw string count as instrumented")
+	}
+
+	stripped, count := StripContents(contents)
+	if count != 0 || JoinLines(stripped) != src {
+		t.Errorf("stripped %d line(s), got\n%s", count, JoinLines(stripped))
+	}
+}
+
+func TestStripLineDirectives(t *testing.T) {
+	src := `package p
+
+func f(n int) int {
+//line parser.go:10
+	if n > 0 {
+		return n
+	}
+
+	return 0
+}
+`
+
+	var opts Options
+	fs := NewFlagSet(FindCommand("instrument"))
+	AddInstrumentFlags(fs, &opts)
+	opts.LineFile = "/src/p.go"
+
+	out, _, err := InstrumentSource("p.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(out), "\n//line /src/p.go:") {
+		t.Fatalf("no //line directives in\n%s", out)
+	}
+
+	contents, err := ReadLines(strings.NewReader(string(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stripped, _ := StripContents(contents)
+	got := JoinLines(FormatStripped("p.go", stripped, "\t"))
+	if got != src {
+		t.Errorf("stripping\n%s\ngave\n%s\nwant\n%s", out, got, src)
+	}
+
+	// the ones the files without markers fall back to
+	stripped, _ = StripLines(contents)
+	got = JoinLines(FormatStripped("p.go", stripped, "\t"))
+	if got != src {
+		t.Errorf("stripping the lines of\n%s\ngave\n%s\nwant\n%s", out, got, src)
+	}
+}
+
+func TestStripHandWrittenLogs(t *testing.T) {
+	src := `package p
+
+import "fmt"
+
+func f() {
+	fmt.Println("Starting func f")
+	fmt.Printf("Starting func f with values: n: %+v\n", 1)
+	fmt.Println("Exiting func f from line 8")
+}
+`
+
+	contents, err := ReadLines(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IsInstrumented(contents) {
+		t.Errorf("hand written logs count as instrumented")
+	}
+
+	stripped, count := StripContents(contents)
+	if count != 0 || JoinLines(stripped) != src {
+		t.Errorf("stripped %d line(s), got\n%s", count, JoinLines(stripped))
+	}
+
+	stripped, count = StripLines(contents)
+	if count != 0 || JoinLines(stripped) != src {
+		t.Errorf("stripped %d line(s) of the lines, got\n%s", count, JoinLines(stripped))
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// what a redacted value is logged as
+const Redacted = "[REDACTED]"
+
+// the parameters and results -redact hides when it isn't given
+var DefaultRedactPatterns = []string{"*password*", "*passwd*", "*secret*", "*token*", "*apikey*", "*api_key*", "*credential*"}
+
+// the types -skip-type leaves out when it isn't given, chan and func stand
+// for all channel and function types
+var DefaultSkipTypes = []string{"context.Context", "sync.Mutex", "sync.RWMutex", "sync.WaitGroup", "sync.Once", "sync.Cond", "chan", "func"}
+
+// IsSkippedType reports whether values of typ, as written in the source, are
+// logged as just their type. Printing a context dumps its whole chain,
+// printing a mutex or WaitGroup reads it while other goroutines use it.
+func IsSkippedType(typ string, opts Options) bool {
+	skipped := []string(opts.SkipTypes)
+	if len(skipped) == 0 {
+		skipped = DefaultSkipTypes
+	}
+
+	typ = strings.TrimPrefix(typ, "*")
+
+	for _, skip := range skipped {
+		switch {
+		case skip == typ:
+			return true
+		case skip == "chan" && (strings.HasPrefix(typ, "chan") || strings.HasPrefix(typ, "<-chan")):
+			return true
+		case skip == "func" && strings.HasPrefix(typ, "func("):
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsRedacted reports whether the value of the parameter or result called
+// name must not be logged. Patterns are globs matched case insensitively.
+func IsRedacted(name string, opts Options) bool {
+	patterns := []string(opts.Redact.StringList)
+	if len(patterns) == 0 {
+		patterns = DefaultRedactPatterns
+	}
+
+	for _, pattern := range patterns {
+		ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FormatValue is the verb the value of name is logged with and the
+// expression for it, expr being what holds the value and typ its type
+func FormatValue(name string, typ string, expr string, opts Options) (string, string) {
+	if name != "" && IsRedacted(name, opts) {
+		return "%s", strconv.Quote(Redacted)
+	}
+
+	if typ != "" && IsSkippedType(typ, opts) {
+		return "%s", strconv.Quote("<" + typ + ">")
+	}
+
+	if opts.Deref && strings.HasPrefix(typ, "*") {
+		expr = RuntimeName + ".Deref(" + expr + ")"
+	}
+
+	if opts.MaxValueLen > 0 {
+		return "%s", fmt.Sprintf("%s.Truncate(%s, %d)", RuntimeName, expr, opts.MaxValueLen)
+	}
+
+	return "%+v", expr
+}
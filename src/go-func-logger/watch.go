@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watcher re-instruments the resolved files of its paths whose modification
+// time or size changed. fsnotify tells it when to look, it watches the
+// directories of the files and every directory below a directory path, so
+// files and packages that appear after the watch started are noticed too.
+type Watcher struct {
+	Paths []string
+	Opts  Options
+	Delay time.Duration // how long to wait for more events before instrumenting
+
+	seen    map[string]fileStamp
+	watched map[string]bool
+}
+
+func NewWatcher(paths []string, opts Options, delay time.Duration) *Watcher {
+	return &Watcher{
+		Paths:   paths,
+		Opts:    opts,
+		Delay:   delay,
+		seen:    make(map[string]fileStamp),
+		watched: make(map[string]bool),
+	}
+}
+
+// Poll instruments every target that changed since the last call, the first
+// call instruments everything
+func (w *Watcher) Poll() error {
+	var changed []Target
+	var errs []error
+
+	for _, path := range w.Paths {
+		targets, err := ResolveTargets(path, w.Opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, target := range targets {
+			info, err := os.Stat(target.Path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			stamp := fileStamp{modTime: info.ModTime(), size: info.Size()}
+			if prev, ok := w.seen[target.Path]; ok && prev == stamp {
+				continue
+			}
+
+			w.seen[target.Path] = stamp
+			changed = append(changed, target)
+		}
+	}
+
+	errs = append(errs, InstrumentTargets(changed, w.Opts))
+	return errors.Join(errs...)
+}
+
+// WatchDirs are the directories of the files seen so far and the directories
+// given as paths with everything below them the walks of FindGoFiles go into,
+// so .git, vendor and the runtime copy don't trigger a poll
+func (w *Watcher) WatchDirs() []string {
+	var dirs []string
+
+	for path := range w.seen {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+
+	for _, path := range w.Paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		filepath.WalkDir(path, func(dir string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(path, dir)
+			if err != nil {
+				return err
+			}
+
+			if dir != path && !w.Opts.Filter.MatchDir(rel) {
+				return filepath.SkipDir
+			}
+
+			dirs = append(dirs, dir)
+			return nil
+		})
+	}
+
+	return dirs
+}
+
+// Forget drops a directory that was removed or renamed, fsnotify stops
+// watching it by itself, so it is watched again if it comes back
+func (w *Watcher) Forget(event fsnotify.Event) {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		delete(w.watched, event.Name)
+	}
+}
+
+// Run instruments everything and then again whenever a watched directory
+// changes until the process is interrupted. Failures are reported and the
+// watch carries on so a file saved mid-edit does not end the session.
+func (w *Watcher) Run() error {
+	notify, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer notify.Close()
+
+	for {
+		err = w.Poll()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		for _, dir := range w.WatchDirs() {
+			if w.watched[dir] {
+				continue
+			}
+
+			err = notify.Add(dir)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+
+			w.watched[dir] = true
+		}
+
+		select {
+		case event := <-notify.Events:
+			w.Forget(event)
+		case err = <-notify.Errors:
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+
+		// an editor saving a file causes a burst of events, they are handled
+		// in one go
+		timer := time.NewTimer(w.Delay)
+	drain:
+		for {
+			select {
+			case event := <-notify.Events:
+				w.Forget(event)
+			case <-timer.C:
+				break drain
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWatchDirs(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, sub := range []string{"pkg/sub", ".git/objects", "vendor/v", "testdata", DepDir + "/" + RuntimeName} {
+		err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(sub)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var opts Options
+	w := NewWatcher([]string{dir}, opts, 0)
+
+	got := strings.Join(w.WatchDirs(), "\n")
+	want := strings.Join([]string{dir, filepath.Join(dir, "pkg"), filepath.Join(dir, "pkg", "sub")}, "\n")
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	opts.Filter.Vendor = true
+	w = NewWatcher([]string{dir}, opts, 0)
+	if got := w.WatchDirs(); len(got) != 5 {
+		t.Errorf("got %d directories with -vendor, want 5:\n%s", len(got), strings.Join(got, "\n"))
+	}
+}